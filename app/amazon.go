@@ -2,6 +2,7 @@ package app
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -10,20 +11,66 @@ import (
 	"github.com/ngs/go-amazon-product-advertising-api/amazon"
 )
 
-var currentClient = 0
-
-const retryMax = 5
 const requestThrottleError = "You are submitting requests too quickly. Please retry your requests at a slower rate."
 
 // Amazon returns amazon client
 func (app *App) Amazon() *amazon.Client {
-	client := app.AmazonClients[currentClient]
-	currentClient++
-	app.Log.Printf("Using Amazon Client %d of %d", currentClient, len(app.AmazonClients))
-	if currentClient == len(app.AmazonClients) {
-		currentClient = 0
+	return app.AmazonClients.Next()
+}
+
+// withAmazon calls fn with rotated clients under the Amazon retry policy and
+// classifies returned error
+func (app *App) withAmazon(operation string, fn func(client *amazon.Client) error) error {
+	return amazonError(app.AmazonRetry.Do(operation, func() error {
+		if err := app.AmazonLimiter.Wait(); err != nil {
+			app.Log.Printf("%v rejected: %v", operation, err)
+			return err
+		}
+		client := app.Amazon()
+		err := fn(client)
+		if isThrottleError(err) {
+			app.AmazonClients.MarkThrottled(client)
+		}
+		return err
+	}))
+}
+
+func amazonErrorCode(err error) amazon.ErrorCode {
+	switch e := err.(type) {
+	case amazon.Error:
+		return e.Code
+	case amazon.Errors:
+		if len(e.ErrorNode) > 0 {
+			return e.ErrorNode[0].Code
+		}
+	case *amazon.Errors:
+		if len(e.ErrorNode) > 0 {
+			return e.ErrorNode[0].Code
+		}
+	case interface {
+		Code() amazon.ErrorCode
+	}:
+		return e.Code()
 	}
-	return client
+	return ""
+}
+
+func isThrottleError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return amazonErrorCode(err) == amazon.RequestThrottled ||
+		strings.Contains(err.Error(), requestThrottleError)
+}
+
+func isRetryableAmazonError(err error) bool {
+	if isThrottleError(err) || amazonErrorCode(err) == amazon.InternalError {
+		return true
+	}
+	if e, ok := err.(net.Error); ok {
+		return e.Temporary() || e.Timeout()
+	}
+	return false
 }
 
 func (app *App) setupAmazonClients() error {
@@ -43,7 +90,27 @@ func (app *App) setupAmazonClients() error {
 		}
 		clients = append(clients, client)
 	}
-	app.AmazonClients = clients
+	coolDown, err := envDuration("AMAZON_THROTTLE_COOLDOWN", defaultAmazonThrottleCoolDown)
+	if err != nil {
+		return err
+	}
+	app.AmazonClients = NewAmazonClientPool(clients, coolDown, app.Log)
+	rate, err := envInt("AMAZON_REQUESTS_PER_SECOND", 1)
+	if err != nil {
+		return err
+	}
+	maxWait, err := envDuration("AMAZON_RATE_LIMIT_WAIT", 5*time.Second)
+	if err != nil {
+		return err
+	}
+	app.AmazonLimiter = NewRateLimiter(float64(rate*len(clients)), len(clients), maxWait)
+	policy, err := RetryPolicyFromEnvironment("AMAZON", app.Log)
+	if err != nil {
+		return err
+	}
+	policy.Retryable = isRetryableAmazonError
+	app.Log.Printf("Amazon retry policy: %v", policy)
+	app.AmazonRetry = policy
 	return nil
 }
 
@@ -53,11 +120,24 @@ func getAmazonItemCarousel(items []amazon.Item,
 		imgURL string,
 		label string,
 		title string) []linebot.TemplateAction) *linebot.CarouselTemplate {
+	template, _ := getAmazonItemCarouselWithText(items, nil, buildActions)
+	return template
+}
+
+func getAmazonItemCarouselWithText(items []amazon.Item,
+	buildText func(item amazon.Item, label string) string,
+	buildActions func(
+		item amazon.Item,
+		imgURL string,
+		label string,
+		title string) []linebot.TemplateAction) (*linebot.CarouselTemplate, int) {
 	var columns []*linebot.CarouselColumn
+	consumed := 0
 	for _, item := range items {
 		if len(columns) == 5 {
 			break
 		}
+		consumed++
 		title := []rune(item.ItemAttributes.Title)
 		if len(title) == 0 || len(item.DetailPageURL) == 0 || len(item.DetailPageURL) > 1000 {
 			continue
@@ -95,67 +175,157 @@ func getAmazonItemCarousel(items []amazon.Item,
 		}
 		strTitle := string(title[0:len(title)])
 		actions := buildActions(item, imgURL, label, strTitle)
+		text := label
+		if buildText != nil {
+			text = buildText(item, label)
+		}
+		text = truncateRunes(text, 60)
 		column := linebot.NewCarouselColumn(
 			imgURL,
 			strTitle,
-			label,
+			text,
 			actions...,
 		)
 		columns = append(columns, column)
 	}
-	return linebot.NewCarouselTemplate(columns...)
+	return linebot.NewCarouselTemplate(columns...), consumed
+}
+
+// pagedItemCarousels returns up to cartCarouselsMax carousels of items in the
+// page, and whether more pages follow
+func pagedItemCarousels(items []amazon.Item, page int, altText string,
+	buildText func(item amazon.Item, label string) string,
+	buildActions func(
+		item amazon.Item,
+		imgURL string,
+		label string,
+		title string) []linebot.TemplateAction) ([]linebot.Message, bool) {
+	pageSize := carouselColumnsMax * cartCarouselsMax
+	pageItems := []amazon.Item{}
+	if page*pageSize < len(items) {
+		pageItems = items[page*pageSize:]
+	}
+	messages := []linebot.Message{}
+	for len(pageItems) > 0 && len(messages) < cartCarouselsMax {
+		template, consumed := getAmazonItemCarouselWithText(pageItems, buildText, buildActions)
+		pageItems = pageItems[consumed:]
+		if len(template.Columns) > 0 {
+			messages = append(messages, linebot.NewTemplateMessage(altText, template))
+		}
+	}
+	return messages, len(pageItems) > 0
+}
+
+// pageRange returns range of n items on the page of pagedItemCarousels
+func pageRange(n int, page int) (int, int) {
+	pageSize := carouselColumnsMax * cartCarouselsMax
+	start := page * pageSize
+	if start > n {
+		start = n
+	}
+	end := start + pageSize
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// itemsWithASINs returns items of the ASINs
+func itemsWithASINs(items []amazon.Item, ASINs []string) []amazon.Item {
+	wanted := map[string]bool{}
+	for _, ASIN := range ASINs {
+		wanted[ASIN] = true
+	}
+	filtered := []amazon.Item{}
+	for _, item := range items {
+		if wanted[item.ASIN] {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
 }
 
 func (app *App) searchItems(keyword string) ([]amazon.Item, error) {
+	items, _, err := app.searchItemsPage(keyword, amazon.SearchIndexAll, 1)
+	return items, err
+}
+
+// maxItemPage returns the last ItemPage allowed for the search index
+func maxItemPage(index amazon.SearchIndex) int {
+	if index == amazon.SearchIndexAll {
+		return 5
+	}
+	return 10
+}
+
+func (app *App) searchItemsPage(keyword string, index amazon.SearchIndex, page int) ([]amazon.Item, int, error) {
 	param := amazon.ItemSearchParameters{
 		Keywords:    keyword,
-		SearchIndex: amazon.SearchIndexAll,
+		SearchIndex: index,
+		ItemPage:    page,
 		ResponseGroups: []amazon.ItemSearchResponseGroup{
 			amazon.ItemSearchResponseGroupLarge,
 		},
 	}
-	retryCount := 0
-	for {
-		res, err := app.Amazon().ItemSearch(param).Do()
+	var res *amazon.ItemSearchResponse
+	err := app.withAmazon("ItemSearch", func(client *amazon.Client) (err error) {
+		res, err = client.ItemSearch(param).Do()
+		return
+	})
+	if err != nil {
+		if errorKindOf(err) == ErrorKindNoResults {
+			return []amazon.Item{}, 0, nil
+		}
+		app.Log.Printf("Got error %v %v", err, param)
+		return []amazon.Item{}, 0, err
+	}
+	return res.Items.Item, res.Items.TotalPages, nil
+}
+
+// lookupItemsMax is the maximum number of IDs in an ItemLookup request
+const lookupItemsMax = 10
+
+func (app *App) lookupItems(ids []string) ([]amazon.Item, error) {
+	return app.lookupItemsBy(ids, amazon.IDTypeASIN, "")
+}
+
+// lookupItemsBy looks up items by IDs of the type in chunks, where index is
+// required unless the type is ASIN
+func (app *App) lookupItemsBy(ids []string, idType amazon.IDType, index amazon.SearchIndex) ([]amazon.Item, error) {
+	items := []amazon.Item{}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > lookupItemsMax {
+			n = lookupItemsMax
+		}
+		res, err := app.lookupItemsChunk(ids[:n], idType, index)
 		if err != nil {
-			if strings.Contains(err.Error(), requestThrottleError) && retryCount < retryMax {
-				retryCount++
-				app.Log.Printf("Retrying %d/%d", retryCount, retryMax)
-				time.Sleep(time.Second)
-				continue
-			}
-			if strings.Contains(err.Error(), string(amazon.NoExactMatches)) {
-				return []amazon.Item{}, nil
-			}
-			app.Log.Printf("Got error %v %v", err, param)
 			return []amazon.Item{}, err
 		}
-		return res.Items.Item, nil
+		items = append(items, res...)
+		ids = ids[n:]
 	}
+	return items, nil
 }
 
-func (app *App) lookupItems(ids []string) ([]amazon.Item, error) {
+func (app *App) lookupItemsChunk(ids []string, idType amazon.IDType, index amazon.SearchIndex) ([]amazon.Item, error) {
 	param := amazon.ItemLookupParameters{
-		ItemIDs: ids,
-		IDType:  amazon.IDTypeASIN,
+		ItemIDs:     ids,
+		IDType:      idType,
+		SearchIndex: index,
 		ResponseGroups: []amazon.ItemLookupResponseGroup{
 			amazon.ItemLookupResponseGroupLarge,
 		},
 	}
-	retryCount := 0
-	for {
-		res, err := app.Amazon().ItemLookup(param).Do()
-		if err != nil {
-			if strings.Contains(err.Error(), requestThrottleError) && retryCount < retryMax {
-				retryCount++
-				app.Log.Printf("Retrying %d/%d", retryCount, retryMax)
-				time.Sleep(time.Second)
-				continue
-			}
-			return []amazon.Item{}, err
-		}
-		return res.Items.Item, nil
+	var res *amazon.ItemLookupResponse
+	err := app.withAmazon("ItemLookup", func(client *amazon.Client) (err error) {
+		res, err = client.ItemLookup(param).Do()
+		return
+	})
+	if err != nil {
+		return []amazon.Item{}, err
 	}
+	return res.Items.Item, nil
 }
 
 func (app *App) searchLocalBooks(area []string) ([]amazon.Item, error) {
@@ -168,19 +338,13 @@ func (app *App) searchLocalBooks(area []string) ([]amazon.Item, error) {
 		Power:          power,
 		BrowseNode:     "492090",
 	}
-	retryCount := 0
-	for {
-		res, err := app.Amazon().ItemSearch(param).Do()
-		if err != nil {
-			if strings.Contains(err.Error(), requestThrottleError) && retryCount < retryMax {
-				retryCount++
-				app.Log.Printf("Retrying %d/%d", retryCount, retryMax)
-				time.Sleep(time.Second)
-				continue
-			}
-			return []amazon.Item{}, err
-		}
-		return res.Items.Item, nil
-
+	var res *amazon.ItemSearchResponse
+	err := app.withAmazon("ItemSearch", func(client *amazon.Client) (err error) {
+		res, err = client.ItemSearch(param).Do()
+		return
+	})
+	if err != nil {
+		return []amazon.Item{}, err
 	}
+	return res.Items.Item, nil
 }
@@ -0,0 +1,232 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/ngs/go-amazon-product-advertising-api/amazon"
+)
+
+const amazonCartKeyPrefix = "buychat:amazon-cart:"
+
+// AmazonCart is a remote cart on Amazon persisted for a chat cart. Changes
+// counts changes of the chat cart, Cleared is Changes when the chat cart was
+// last cleared, and Synced is Changes applied to the remote cart.
+type AmazonCart struct {
+	ID      string
+	HMAC    string
+	Changes int `json:",omitempty"`
+	Cleared int `json:",omitempty"`
+	Synced  int `json:",omitempty"`
+}
+
+var errAmazonCartChanged = errors.New("Amazon cart was replaced")
+
+func (app *App) loadAmazonCart(cartKey string) (*AmazonCart, error) {
+	str, ok, err := app.Store.Get(amazonCartKeyPrefix + cartKey)
+	if err != nil || !ok {
+		return nil, storageError(err)
+	}
+	var cart AmazonCart
+	if err := json.Unmarshal([]byte(str), &cart); err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// saveAmazonCart saves remote cart, which expires along with the chat cart
+func (app *App) saveAmazonCart(cartKey string, cart *amazon.Cart) error {
+	data, _ := json.Marshal(&AmazonCart{ID: cart.ID, HMAC: cart.HMAC})
+	return storageError(app.Store.Set(amazonCartKeyPrefix+cartKey, string(data), app.CartPolicy.TTL))
+}
+
+// updateAmazonCart atomically applies fn to the persisted remote cart,
+// refreshing its expiry. It does nothing when there is no remote cart.
+func (app *App) updateAmazonCart(cartKey string, fn func(cart *AmazonCart) error) error {
+	err := app.Store.Update(amazonCartKeyPrefix+cartKey, app.CartPolicy.TTL, func(str string, ok bool) (string, error) {
+		if !ok {
+			return "", errAmazonCartChanged
+		}
+		var cart AmazonCart
+		if err := json.Unmarshal([]byte(str), &cart); err != nil {
+			return "", err
+		}
+		if err := fn(&cart); err != nil {
+			return "", err
+		}
+		data, _ := json.Marshal(&cart)
+		return string(data), nil
+	})
+	if err == errAmazonCartChanged {
+		return nil
+	}
+	return err
+}
+
+// markAmazonCartStale records a change of the chat cart, which is applied to
+// the remote cart on next access instead of calling the API on every change.
+// Clearing is recorded separately so that it is applied with CartClear.
+func (app *App) markAmazonCartStale(cartKey string, cleared bool) {
+	if err := app.updateAmazonCart(cartKey, func(cart *AmazonCart) error {
+		cart.Changes++
+		if cleared {
+			cart.Cleared = cart.Changes
+		}
+		return nil
+	}); err != nil {
+		app.Log.Printf("Failed to mark Amazon cart stale %v %v", err, cartKey)
+		app.dropAmazonCart(cartKey)
+	}
+}
+
+// dropAmazonCart forgets remote cart so that it is created again from the
+// chat cart on next access
+func (app *App) dropAmazonCart(cartKey string) {
+	if err := app.Store.Del(amazonCartKeyPrefix + cartKey); err != nil {
+		app.Log.Printf("Failed to drop Amazon cart %v %v", err, cartKey)
+	}
+}
+
+func isInvalidAmazonCartError(err error) bool {
+	if e, ok := err.(*Error); ok {
+		err = e.Err
+	}
+	code := amazonErrorCode(err)
+	return code == amazon.InvalidCartID || code == amazon.InvalidHMAC
+}
+
+// createAmazonCart creates remote cart with items in the chat cart
+func (app *App) createAmazonCart(cartKey string) (*amazon.Cart, error) {
+	items, err := app.getCartItems(cartKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	params := amazon.CartCreateParameters{}
+	for _, item := range items {
+		params.Items.AddASIN(item.ASIN, item.Quantity)
+	}
+	var res *amazon.CartCreateResponse
+	err = app.withAmazon("CartCreate", func(client *amazon.Client) (err error) {
+		res, err = client.CartCreate(params).Do()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res.Cart, app.saveAmazonCart(cartKey, &res.Cart)
+}
+
+// GetAmazonCart returns remote cart for the chat cart, creating it when it
+// does not exist or is no longer valid, and applying changes of the chat cart
+// since last access. It returns nil for empty carts.
+func (app *App) GetAmazonCart(cartKey string) (*amazon.Cart, error) {
+	remote, err := app.loadAmazonCart(cartKey)
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return app.createAmazonCart(cartKey)
+	}
+	var res *amazon.CartGetResponse
+	err = app.withAmazon("CartGet", func(client *amazon.Client) (err error) {
+		res, err = client.CartGet(amazon.CartGetParameters{CartID: remote.ID, HMAC: remote.HMAC}).Do()
+		return
+	})
+	if isInvalidAmazonCartError(err) {
+		return app.createAmazonCart(cartKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cart := &res.Cart
+	if remote.Changes != remote.Synced {
+		if cart, err = app.syncAmazonCart(cartKey, remote, cart); err != nil {
+			app.Log.Printf("Failed to sync Amazon cart %v %v", err, cartKey)
+			app.dropAmazonCart(cartKey)
+			return app.createAmazonCart(cartKey)
+		}
+	}
+	if len(cart.CartItems.CartItem) == 0 {
+		if size, err := app.CartSize(cartKey); err != nil || size > 0 {
+			app.dropAmazonCart(cartKey)
+			return app.createAmazonCart(cartKey)
+		}
+		return nil, nil
+	}
+	return cart, nil
+}
+
+// syncAmazonCart applies quantities of items in the chat cart to the remote
+// cart, clearing it first when the chat cart was cleared since last sync, and
+// records changes until remote.Changes as synced
+func (app *App) syncAmazonCart(cartKey string, remote *AmazonCart, cart *amazon.Cart) (*amazon.Cart, error) {
+	items, err := app.getCartItems(cartKey)
+	if err != nil {
+		return nil, err
+	}
+	if remote.Cleared > remote.Synced && len(cart.CartItems.CartItem) > 0 {
+		err := app.withAmazon("CartClear", func(client *amazon.Client) error {
+			res, err := client.CartClear(amazon.CartClearParameters{CartID: remote.ID, HMAC: remote.HMAC}).Do()
+			if res != nil {
+				cart = &res.Cart
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	quantities := map[string]int{}
+	for _, item := range items {
+		quantities[item.ASIN] = item.Quantity
+	}
+	modify := amazon.CartModifyParameters{CartID: remote.ID, HMAC: remote.HMAC}
+	for _, item := range cart.CartItems.CartItem {
+		quantity := quantities[item.ASIN]
+		delete(quantities, item.ASIN)
+		if item.Quantity != quantity {
+			modify.Items.ModifyQuantity(item.ID, quantity)
+		}
+	}
+	if len(modify.Items.Items) > 0 {
+		err := app.withAmazon("CartModify", func(client *amazon.Client) error {
+			res, err := client.CartModify(modify).Do()
+			if res != nil {
+				cart = &res.Cart
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	add := amazon.CartAddParameters{CartID: remote.ID, HMAC: remote.HMAC}
+	for _, item := range items {
+		if quantity, ok := quantities[item.ASIN]; ok {
+			add.Items.AddASIN(item.ASIN, quantity)
+		}
+	}
+	if len(add.Items.Items) > 0 {
+		err := app.withAmazon("CartAdd", func(client *amazon.Client) error {
+			res, err := client.CartAdd(add).Do()
+			if res != nil {
+				cart = &res.Cart
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = app.updateAmazonCart(cartKey, func(stored *AmazonCart) error {
+		if stored.ID != remote.ID {
+			return errAmazonCartChanged
+		}
+		stored.Synced = remote.Changes
+		return nil
+	})
+	return cart, storageError(err)
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ngs/go-amazon-product-advertising-api/amazon"
+)
+
+const defaultAmazonThrottleCoolDown = 10 * time.Second
+
+type amazonClientState struct {
+	client         *amazon.Client
+	name           string
+	throttledUntil time.Time
+	requests       int
+	throttles      int
+}
+
+// AmazonClientPool rotates Amazon clients for each access key, skipping keys
+// that are cooling down after being throttled
+type AmazonClientPool struct {
+	CoolDown time.Duration
+	Log      *log.Logger
+	mu       sync.Mutex
+	states   []*amazonClientState
+	next     int
+}
+
+// NewAmazonClientPool returns new pool of clients
+func NewAmazonClientPool(clients []*amazon.Client, coolDown time.Duration, logger *log.Logger) *AmazonClientPool {
+	pool := &AmazonClientPool{CoolDown: coolDown, Log: logger}
+	for _, client := range clients {
+		name := client.AccessKeyID
+		if len(name) > 4 {
+			name = "..." + name[len(name)-4:]
+		}
+		pool.states = append(pool.states, &amazonClientState{client: client, name: name})
+	}
+	return pool
+}
+
+// Len returns number of clients
+func (p *AmazonClientPool) Len() int {
+	return len(p.states)
+}
+
+// Next returns next available client. When every client is cooling down, the
+// one recovering first is returned.
+func (p *AmazonClientPool) Next() *amazon.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var selected *amazonClientState
+	index := 0
+	for i := 0; i < len(p.states); i++ {
+		j := (p.next + i) % len(p.states)
+		state := p.states[j]
+		if !now.Before(state.throttledUntil) {
+			selected, index = state, j
+			break
+		}
+		if selected == nil || state.throttledUntil.Before(selected.throttledUntil) {
+			selected, index = state, j
+		}
+	}
+	p.next = (index + 1) % len(p.states)
+	selected.requests++
+	p.Log.Printf("Using Amazon Client %d of %d (%v)", index+1, len(p.states), selected.name)
+	return selected.client
+}
+
+// MarkThrottled puts the client into cool-down
+func (p *AmazonClientPool) MarkThrottled(client *amazon.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, state := range p.states {
+		if state.client != client {
+			continue
+		}
+		state.throttles++
+		state.throttledUntil = time.Now().Add(p.CoolDown)
+		p.Log.Printf("Amazon Client %d of %d (%v) throttled, cooling down for %v (%d throttled in %d requests, %d of %d healthy)",
+			i+1, len(p.states), state.name, p.CoolDown, state.throttles, state.requests,
+			p.healthyCount(), len(p.states))
+		return
+	}
+}
+
+func (p *AmazonClientPool) healthyCount() int {
+	now := time.Now()
+	count := 0
+	for _, state := range p.states {
+		if !now.Before(state.throttledUntil) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// amazonURLRE matches amazon.co.jp product URLs such as /dp/ASIN,
+// /gp/product/ASIN, /o/ASIN and mobile /gp/aw/d/ASIN, optionally after a slug,
+// which never spans into the next URL. Other marketplaces are not matched, as
+// their ASINs may refer to other products in the Japan locale.
+var amazonURLRE = regexp.MustCompile(`(?i)https?://(?:[a-z0-9-]+\.)*amazon\.co\.jp/(?:[^\s?#:]*/)?(?:dp|dp/product|gp/product|gp/aw/d|o|o/ASIN|exec/obidos/ASIN)/([A-Z0-9]{10})(?:[^A-Za-z0-9]|$)`)
+
+// amazonShortURLRE matches share links of amzn.asia and amzn.to, which
+// redirect to product URLs
+var amazonShortURLRE = regexp.MustCompile(`(?i)https?://(?:amzn\.asia/d|amzn\.to)/[A-Za-z0-9]+`)
+
+// amazonShortURLTimeout limits time to resolve all share links in a message,
+// so that resolving them never uses up the reply token
+var amazonShortURLTimeout = 3 * time.Second
+
+var amazonShortURLClient = &http.Client{}
+
+// findAmazonASINs returns ASINs in Amazon product URLs in the text, up to a
+// carousel
+func findAmazonASINs(text string) []string {
+	ASINs := []string{}
+	seen := map[string]bool{}
+	for _, m := range amazonURLRE.FindAllStringSubmatch(text, -1) {
+		ASIN := strings.ToUpper(m[1])
+		if seen[ASIN] {
+			continue
+		}
+		seen[ASIN] = true
+		ASINs = append(ASINs, ASIN)
+		if len(ASINs) == carouselColumnsMax {
+			break
+		}
+	}
+	return ASINs
+}
+
+// resolveAmazonShortURLs returns URLs which share links in the text redirect
+// to, resolving links concurrently within amazonShortURLTimeout and skipping
+// links which fail to resolve
+func (app *App) resolveAmazonShortURLs(text string) []string {
+	links := amazonShortURLRE.FindAllString(text, carouselColumnsMax)
+	resolved := make([]string, len(links))
+	ctx, cancel := context.WithTimeout(context.Background(), amazonShortURLTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, link := range links {
+		wg.Add(1)
+		go func(i int, link string) {
+			defer wg.Done()
+			req, err := http.NewRequest("HEAD", link, nil)
+			if err != nil {
+				app.Log.Printf("Failed to resolve %v %v", err, link)
+				return
+			}
+			res, err := amazonShortURLClient.Do(req.WithContext(ctx))
+			if err != nil {
+				app.Log.Printf("Failed to resolve %v %v", err, link)
+				return
+			}
+			res.Body.Close()
+			resolved[i] = res.Request.URL.String()
+		}(i, link)
+	}
+	wg.Wait()
+	urls := []string{}
+	for _, url := range resolved {
+		if url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// findAmazonLinkASINs returns ASINs in Amazon product URLs and share links in
+// the text
+func (app *App) findAmazonLinkASINs(text string) []string {
+	if urls := app.resolveAmazonShortURLs(text); len(urls) > 0 {
+		text += "\n" + strings.Join(urls, "\n")
+	}
+	return findAmazonASINs(text)
+}
+
+// replyAmazonURLs replies carousel of items of the ASINs found in URLs
+func (app *App) replyAmazonURLs(delivery *Delivery, ASINs []string) error {
+	items, err := app.lookupItems(ASINs)
+	if kind := errorKindOf(err); kind == ErrorKindNoResults || kind == ErrorKindInvalidParameter {
+		app.Log.Printf("No items for URLs %v %v", err, ASINs)
+		items = nil
+	} else if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return noResultsError("Amazon のリンク")
+	}
+	return app.replyItemCarousel(delivery, "Amazon のリンクの商品", items)
+}
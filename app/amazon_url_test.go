@@ -0,0 +1,98 @@
+package app
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindAmazonASINs(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected []string
+	}{
+		{"https://www.amazon.co.jp/dp/4873117526", []string{"4873117526"}},
+		{"https://www.amazon.co.jp/gp/product/B01N5IB20Q/ref=xx", []string{"B01N5IB20Q"}},
+		{"https://www.amazon.co.jp/プログラミング言語Go/dp/4621300253/ref=sr_1_1?keywords=go", []string{"4621300253"}},
+		{"https://amazon.co.jp/gp/aw/d/B01N5IB20Q?ie=UTF8", []string{"B01N5IB20Q"}},
+		{"https://m.amazon.co.jp/dp/B01N5IB20Q", []string{"B01N5IB20Q"}},
+		{"https://www.amazon.co.jp/o/ASIN/B01N5IB20Q#detail", []string{"B01N5IB20Q"}},
+		{"http://www.amazon.co.jp/exec/obidos/ASIN/4873117526/", []string{"4873117526"}},
+		{"https://www.amazon.co.jp/dp/b01n5ib20q", []string{"B01N5IB20Q"}},
+		{"これ https://www.amazon.co.jp/dp/B01N5IB20Qがほしい", []string{"B01N5IB20Q"}},
+		{"https://www.amazon.co.jp/dp/B01N5IB20Q、https://www.amazon.co.jp/dp/4873117526", []string{"B01N5IB20Q", "4873117526"}},
+		{"https://www.amazon.co.jp/dp/B01N5IB20Q https://www.amazon.co.jp/dp/B01N5IB20Q/", []string{"B01N5IB20Q"}},
+		{"https://www.amazon.co.jp/dp/B01N5IB20QX", []string{}},
+		{"https://www.amazon.co.jp/dp/B01N5IB20", []string{}},
+		{"https://www.example.com/dp/B01N5IB20Q", []string{}},
+		{"https://www.amazon.com/dp/B01N5IB20Q", []string{}},
+		{"https://www.amazon.co.uk/gp/product/B01N5IB20Q", []string{}},
+		{"https://www.amazon.co.jp.example.com/dp/B01N5IB20Q", []string{}},
+		{"https://www.amazon.co.jp/s?k=golang", []string{}},
+		{
+			"https://amazon.co.jp/dp/B000000001 https://amazon.co.jp/dp/B000000002 https://amazon.co.jp/dp/B000000003 " +
+				"https://amazon.co.jp/dp/B000000004 https://amazon.co.jp/dp/B000000005 https://amazon.co.jp/dp/B000000006",
+			[]string{"B000000001", "B000000002", "B000000003", "B000000004", "B000000005"},
+		},
+	}
+	for _, c := range cases {
+		if actual := findAmazonASINs(c.text); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%v: expected %v but got %v", c.text, c.expected, actual)
+		}
+	}
+}
+
+func TestAmazonShortURLRE(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected []string
+	}{
+		{"https://amzn.asia/d/3ABcdEf", []string{"https://amzn.asia/d/3ABcdEf"}},
+		{"見て https://amzn.to/2xYz9Qwこれ", []string{"https://amzn.to/2xYz9Qw"}},
+		{"https://amzn.asia/3ABcdEf", nil},
+		{"https://www.amazon.co.jp/dp/B01N5IB20Q", nil},
+	}
+	for _, c := range cases {
+		if actual := amazonShortURLRE.FindAllString(c.text, -1); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%v: expected %v but got %v", c.text, c.expected, actual)
+		}
+	}
+}
+
+type shortURLTransport struct{}
+
+func (shortURLTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res := &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}
+	switch req.URL.Host {
+	case "amzn.asia":
+		res.StatusCode = 301
+		res.Header.Set("Location", "https://www.amazon.co.jp/dp/"+strings.ToUpper(req.URL.Path[len("/d/"):]))
+	case "amzn.to":
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	return res, nil
+}
+
+func TestResolveAmazonShortURLs(t *testing.T) {
+	transport, timeout := amazonShortURLClient.Transport, amazonShortURLTimeout
+	defer func() {
+		amazonShortURLClient.Transport, amazonShortURLTimeout = transport, timeout
+	}()
+	amazonShortURLClient.Transport = shortURLTransport{}
+	amazonShortURLTimeout = 100 * time.Millisecond
+	app := &App{Log: log.New(ioutil.Discard, "", 0)}
+	started := time.Now()
+	actual := app.resolveAmazonShortURLs("https://amzn.asia/d/b000000001 https://amzn.to/slow1 https://amzn.to/slow2 https://amzn.asia/d/b000000002")
+	expected := []string{"https://www.amazon.co.jp/dp/B000000001", "https://www.amazon.co.jp/dp/B000000002"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+	if elapsed := time.Since(started); elapsed > 2*amazonShortURLTimeout {
+		t.Errorf("expected links to be resolved within %v but took %v", amazonShortURLTimeout, elapsed)
+	}
+}
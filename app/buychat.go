@@ -13,18 +13,27 @@ import (
 	"github.com/garyburd/redigo/redis"
 	apachelog "github.com/lestrrat/go-apache-logformat"
 	"github.com/line/line-bot-sdk-go/linebot"
-	"github.com/ngs/go-amazon-product-advertising-api/amazon"
 	yolp "github.com/ngs/go-yolp"
 )
 
 // App main app
 type App struct {
-	ZbarScanner   *zbar.Scanner
-	Line          *linebot.Client
-	AmazonClients []*amazon.Client
-	Log           *log.Logger
-	RedisConn     redis.Conn
-	YOLP          *yolp.Client
+	ZbarScanner    *zbar.Scanner
+	Line           *linebot.Client
+	AmazonClients  *AmazonClientPool
+	AmazonRetry    *RetryPolicy
+	AmazonLimiter  *RateLimiter
+	Log            *log.Logger
+	RedisPool      *redis.Pool
+	Carts          CartStore
+	CartPolicy     *CartPolicy
+	Store          Store
+	Queue          *EventQueue
+	DeliveryPolicy *DeliveryPolicy
+	Postbacks      *PostbackCodec
+	Checkout       *CheckoutPolicy
+	YOLP           *yolp.Client
+	AdminToken     string
 }
 
 // New returns new app
@@ -47,6 +56,7 @@ func New() (*App, error) {
 		Line:        line,
 		Log:         logger,
 		ZbarScanner: scanner,
+		AdminToken:  os.Getenv("ADMIN_TOKEN"),
 	}
 	if err := app.setupAmazonClients(); err != nil {
 		return nil, err
@@ -54,7 +64,25 @@ func New() (*App, error) {
 	if err := app.setupYOLPClient(); err != nil {
 		return nil, err
 	}
-	if err := app.SetupRedis(); err != nil {
+	if err := app.SetupCartStore(); err != nil {
+		return nil, err
+	}
+	if err := app.SetupCartPolicy(); err != nil {
+		return nil, err
+	}
+	if err := app.indexExistingCarts(); err != nil {
+		return nil, err
+	}
+	if err := app.SetupEventQueue(); err != nil {
+		return nil, err
+	}
+	if err := app.SetupDelivery(); err != nil {
+		return nil, err
+	}
+	if err := app.SetupPostback(); err != nil {
+		return nil, err
+	}
+	if err := app.SetupCheckout(); err != nil {
 		return nil, err
 	}
 	return app, nil
@@ -64,12 +92,16 @@ func New() (*App, error) {
 func (app *App) Run() error {
 	router := mux.NewRouter()
 	router.HandleFunc("/callback", app.HandleCallback).Methods("POST")
+	router.HandleFunc("/cart/{slug}", app.HandleCheckout).Methods("GET")
 	router.HandleFunc("/cart/{type}/{id}", app.HandleCart).Methods("GET")
+	router.HandleFunc("/admin/carts", app.HandleAdminCarts).Methods("GET")
 	mw := apachelog.CombinedLog.Wrap(router, os.Stderr)
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 	defer app.ZbarScanner.Destroy()
+	app.StartWorkers()
+	app.StartCartSweeper()
 	return http.ListenAndServe(":"+port, mw)
 }
@@ -1,14 +1,13 @@
 package app
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"image"
 	"io"
 	"log"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 
 	zbar "github.com/PeterCxy/gozbar"
@@ -21,6 +20,8 @@ import (
 
 const noimgURL = "https://buychat.s3-ap-northeast-1.amazonaws.com/line-carousel-noimg.png"
 
+var cartHistoryRE = regexp.MustCompile(`^(?:カートの履歴|cart history)\s*(\d*)$`)
+
 // HandleCallback handles POST /callback
 func (app *App) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	events, err := app.Line.ParseRequest(r)
@@ -36,23 +37,18 @@ func (app *App) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Got events %v", events)
 	for _, event := range events {
-		if err := app.HandleEvent(event); err != nil {
-			rollbar.Error(rollbar.ERR, err)
-			app.Log.Printf("Got error %v %v", err, event)
-			if err = app.ReplyText(event.ReplyToken, "ごめんなさい、検索中にエラーが発生してしまいました"); err != nil {
-				rollbar.Error(rollbar.ERR, err)
-				app.Log.Printf("Got error again %v %v", err, event)
-				http.Error(w, err.Error(), 500)
+		if !app.Enqueue(event) {
+			app.Log.Printf("Event queue is full, dropping %v", event)
+			if err := app.ReplyText(NewDelivery(event), "ごめんなさい、混み合っています。しばらくしてから、もう一度お試しください"); err != nil {
+				app.Log.Printf("Got error %v %v", err, event)
 			}
-			rollbar.Wait()
-			return
 		}
 	}
-	r.Write(bytes.NewBufferString("OK"))
+	w.Write([]byte("OK"))
 }
 
 // HandleEvent handles webhook event
-func (app *App) HandleEvent(event *linebot.Event) error {
+func (app *App) HandleEvent(delivery *Delivery, event *linebot.Event) error {
 	if event.Source == nil {
 		return nil
 	}
@@ -68,55 +64,124 @@ func (app *App) HandleEvent(event *linebot.Event) error {
 		cartKey = fmt.Sprintf("buychat:line:user:%v", event.Source.UserID)
 		break
 	}
+	cartKey, err := app.ActiveCartKey(cartKey)
+	if err != nil {
+		return err
+	}
 	switch event.Type {
 	case linebot.EventTypeMessage:
 		switch message := event.Message.(type) {
 		case *linebot.TextMessage:
 			text := strings.ToLower(message.Text)
 			if text == "カートを表示" || text == "show cart" {
-				return app.HandleShowCart(event.ReplyToken, cartKey)
+				return app.HandleShowCart(delivery, cartKey)
+			}
+			if text == "ほしいものリスト" || text == "wishlist" {
+				return app.HandleShowWishlist(delivery, cartKey, 0)
+			}
+			if m := cartHistoryRE.FindStringSubmatch(strings.TrimSpace(text)); m != nil {
+				n, _ := strconv.Atoi(m[1])
+				return app.HandleCartHistory(delivery, cartKey, n)
 			}
-			return app.HandleTextMessage(event.ReplyToken, message.Text)
+			if ok, err := app.HandleCartCommand(delivery, message.Text, cartKey); ok {
+				return err
+			}
+			return app.HandleTextMessage(delivery, message.Text)
 		case *linebot.LocationMessage:
-			app.HandleLocation(event.ReplyToken, message.Latitude, message.Longitude)
+			app.HandleLocation(delivery, message.Latitude, message.Longitude)
 			return nil
 		case *linebot.ImageMessage:
 			messageContent, err := app.Line.GetMessageContent(message.ID).Do()
 			if err != nil {
 				return err
 			}
-			return app.HandleImage(event.ReplyToken, messageContent.Content)
+			return app.HandleImage(delivery, messageContent.Content)
 		}
 	case linebot.EventTypePostback:
-		return app.HandlePostbackData(event.ReplyToken, event.Postback.Data, cartKey)
+		return app.HandlePostbackData(delivery, event.Postback.Data, cartKey)
 	}
 	return nil
 }
 
 // ReplyText replies text
-func (app *App) ReplyText(replyToken string, text string) error {
-	_, err := app.Line.ReplyMessage(replyToken,
-		linebot.NewTextMessage(text)).Do()
-	return err
+func (app *App) ReplyText(delivery *Delivery, text string) error {
+	return app.Reply(delivery, linebot.NewTextMessage(text))
 }
 
 // HandleTextMessage handles text message
-func (app *App) HandleTextMessage(replyToken string, text string) error {
-	items, err := app.searchItems(text)
-	if err != nil {
-		if strings.Contains(err.Error(), requestThrottleError) {
-			return app.ReplyText(replyToken, "申し訳ありません、すこし待ってから、もう一度送信してださい")
+func (app *App) HandleTextMessage(delivery *Delivery, text string) error {
+	if err := app.Acknowledge(delivery, "検索中…", app.AmazonLimiter.Delay()); err != nil {
+		return err
+	}
+	if ASINs := app.findAmazonLinkASINs(text); len(ASINs) > 0 {
+		return app.replyAmazonURLs(delivery, ASINs)
+	}
+	if codes := findProductCodes(text); len(codes) > 0 {
+		if err := app.replyProductCodes(delivery, codes, describeProductCodes(codes)); errorKindOf(err) != ErrorKindNoResults {
+			return err
 		}
+	}
+	return app.replySearchResults(delivery, text, amazon.SearchIndexAll, 1, 0)
+}
+
+// replyProductCodes replies carousel of items exactly matching the codes
+func (app *App) replyProductCodes(delivery *Delivery, codes []ProductCode, subject string) error {
+	items, err := app.lookupProductCodes(codes)
+	if err != nil {
 		return err
 	}
 	if len(items) == 0 {
-		return app.ReplyText(replyToken, `ごめんなさい、"`+text+`" に該当する商品はみつかりませんでした`)
+		return noResultsError(subject)
 	}
-	return app.replyItemCarousel(replyToken, `"`+text+`"の検索結果`, items)
+	return app.replyItemCarousel(delivery, subject+" の検索結果", items)
 }
 
-func (app *App) replyItemCarousel(replyToken string, altText string, items []amazon.Item) error {
-	template := getAmazonItemCarousel(items,
+// replySearchResults replies carousel of search results starting from offset
+// in the ItemPage, with "次の結果" button when more results are available
+func (app *App) replySearchResults(delivery *Delivery, query string, index amazon.SearchIndex, page int, offset int) error {
+	items, totalPages, err := app.searchItemsPage(query, index, page)
+	if err != nil {
+		return err
+	}
+	if offset < len(items) {
+		items = items[offset:]
+	} else {
+		items = []amazon.Item{}
+	}
+	if len(items) == 0 {
+		return noResultsError(`"` + query + `"`)
+	}
+	altText := `"` + query + `"の検索結果`
+	if page > 1 || offset > 0 {
+		altText += " (続き)"
+	}
+	return app.replyItemCarouselWithNext(delivery, altText, items, func(consumed int) *PostbackData {
+		next := &PostbackData{
+			Action:      PostbackActionNextResults,
+			Query:       query,
+			SearchIndex: string(index),
+			Page:        page,
+			Offset:      offset + consumed,
+		}
+		if consumed >= len(items) {
+			if page >= totalPages || page >= maxItemPage(index) {
+				return nil
+			}
+			next.Page = page + 1
+			next.Offset = 0
+		}
+		return next
+	})
+}
+
+func (app *App) replyItemCarousel(delivery *Delivery, altText string, items []amazon.Item) error {
+	return app.replyItemCarouselWithNext(delivery, altText, items, nil)
+}
+
+func (app *App) replyItemCarouselWithNext(delivery *Delivery, altText string, items []amazon.Item,
+	next func(consumed int) *PostbackData) error {
+	encoder := &postbackEncoder{app: app}
+	template, consumed := getAmazonItemCarouselWithText(items, nil,
 		func(item amazon.Item, imgURL string, label string, title string) []linebot.TemplateAction {
 			postbackData := &PostbackData{
 				Action:   PostbackActionAddCart,
@@ -125,44 +190,90 @@ func (app *App) replyItemCarousel(replyToken string, altText string, items []ama
 				Label:    label,
 				Title:    title,
 			}
-			bytes, _ := json.Marshal(postbackData)
 			return []linebot.TemplateAction{
-				linebot.NewPostbackTemplateAction("カートに追加", string(bytes), ""),
+				linebot.NewPostbackTemplateAction("カートに追加", encoder.Encode(postbackData), ""),
+				addWishlistAction(encoder, postbackData),
 				linebot.NewURITemplateAction("Amazon で見る", item.DetailPageURL),
 			}
 		})
 	msg := linebot.NewTemplateMessage(altText, template)
 	json, _ := msg.MarshalJSON()
 	app.Log.Println(string(json))
-	_, err := app.Line.ReplyMessage(replyToken, msg).Do()
-	return err
+	messages := []linebot.Message{msg}
+	if next != nil {
+		if data := next(consumed); data != nil {
+			messages = append(messages, linebot.NewTemplateMessage("次の結果",
+				linebot.NewButtonsTemplate("", "", "さらに検索結果があります",
+					linebot.NewPostbackTemplateAction("次の結果", encoder.Encode(data), ""),
+				)))
+		}
+	}
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return app.Reply(delivery, messages...)
+}
+
+// HandleNextResults handles next results
+func (app *App) HandleNextResults(delivery *Delivery, data PostbackData) error {
+	return app.replySearchResults(delivery, data.Query, amazon.SearchIndex(data.SearchIndex), data.Page, data.Offset)
 }
 
 // HandlePostbackData handles postback data
-func (app *App) HandlePostbackData(replyToken string, dataString string, cartKey string) error {
+func (app *App) HandlePostbackData(delivery *Delivery, dataString string, cartKey string) error {
 	app.Log.Println(dataString, cartKey)
-	var data PostbackData
-	if err := json.Unmarshal([]byte(dataString), &data); err != nil {
+	data, err := app.Postbacks.Decode(dataString)
+	if err == errPostbackExpired {
+		return app.ReplyText(delivery, "この操作の有効期限が切れました。もう一度検索してください")
+	}
+	if err == errPostbackInvalid {
+		app.Log.Printf("Rejected postback data %v %v", dataString, cartKey)
+		return app.ReplyText(delivery, "ごめんなさい、この操作は受け付けられませんでした。もう一度検索してください")
+	}
+	if err != nil {
 		return err
 	}
+	if data.Cart != "" {
+		cartKey = namedCartKey(cartSourceKey(cartKey), data.Cart)
+	}
 	switch data.Action {
 	case PostbackActionAddCart:
-		return app.HandleAddCart(replyToken, data, cartKey)
+		return app.HandleAddCart(delivery, data, cartKey)
 	case PostbackActionClearCart:
-		return app.HandleClearCart(replyToken, cartKey)
+		return app.HandleClearCart(delivery, cartKey)
 	case PostbackActionShowCart:
-		return app.HandleShowCart(replyToken, cartKey)
+		return app.HandleShowCartPage(delivery, cartKey, data.Page)
 	case PostbackActionRemoveCart:
-		return app.HandleRemoveCart(replyToken, data, cartKey)
+		return app.HandleRemoveCart(delivery, data, cartKey)
+	case PostbackActionIncreaseQuantity:
+		return app.HandleChangeQuantity(delivery, data, cartKey, 1)
+	case PostbackActionDecreaseQuantity:
+		return app.HandleChangeQuantity(delivery, data, cartKey, -1)
+	case PostbackActionCartItemMenu:
+		return app.HandleCartItemMenu(delivery, data, cartKey)
+	case PostbackActionNextResults:
+		return app.HandleNextResults(delivery, data)
+	case PostbackActionUndoCart:
+		return app.HandleUndoCart(delivery, data, cartKey)
+	case PostbackActionAddWishlist:
+		return app.HandleAddWishlist(delivery, data, cartKey)
+	case PostbackActionShowWishlist:
+		return app.HandleShowWishlist(delivery, cartKey, data.Page)
+	case PostbackActionRemoveWishlist:
+		return app.HandleRemoveWishlist(delivery, data, cartKey)
+	case PostbackActionMoveToCart:
+		return app.HandleMoveToCart(delivery, data, cartKey)
+	case PostbackActionMoveToWishlist:
+		return app.HandleMoveToWishlist(delivery, data, cartKey)
 	}
 	return nil
 }
 
 // HandleImage handles image
-func (app *App) HandleImage(replyToken string, content io.ReadCloser) error {
+func (app *App) HandleImage(delivery *Delivery, content io.ReadCloser) error {
 	src, _, err := image.Decode(content)
 	if err != nil {
-		return app.ReplyText(replyToken, "バーコードを検知できませんでした")
+		return app.ReplyText(delivery, "バーコードを検知できませんでした")
 	}
 	img := zbar.FromImage(src)
 	itemIDs := []string{}
@@ -174,24 +285,27 @@ func (app *App) HandleImage(replyToken string, content io.ReadCloser) error {
 	}
 	app.Log.Println(itemIDs)
 	if len(itemIDs) > 0 {
-		items, err := app.searchItems(strings.Join(itemIDs, " "))
+		if err := app.Acknowledge(delivery, "検索中…", app.AmazonLimiter.Delay()); err != nil {
+			return err
+		}
 		str := strings.Join(itemIDs, ",")
+		if codes := findProductCodes(strings.Join(itemIDs, " ")); len(codes) > 0 {
+			return app.replyProductCodes(delivery, codes, `バーコード "`+str+`"`)
+		}
+		items, err := app.searchItems(strings.Join(itemIDs, " "))
 		if err != nil {
-			if strings.Contains(err.Error(), requestThrottleError) {
-				return app.ReplyText(replyToken, "申し訳ありません、すこし待ってから、もう一度送信してださい")
-			}
 			return err
 		}
 		if len(items) > 0 {
-			return app.replyItemCarousel(replyToken, `バーコード "`+str+`" の検索結果`, items)
+			return app.replyItemCarousel(delivery, `バーコード "`+str+`" の検索結果`, items)
 		}
-		return app.ReplyText(replyToken, `ごめんなさい、バーコード "`+str+`" に該当する商品はみつかりませんでした`)
+		return noResultsError(`バーコード "` + str + `"`)
 	}
-	return app.ReplyText(replyToken, "バーコードを検知できませんでした")
+	return app.ReplyText(delivery, "バーコードを検知できませんでした")
 }
 
 // HandleLocation handles location
-func (app *App) HandleLocation(replyToken string, latitude float64, longitude float64) error {
+func (app *App) HandleLocation(delivery *Delivery, latitude float64, longitude float64) error {
 	numberRE := regexp.MustCompile("^\\d")
 	res, err := app.YOLP.ReverseGeocoder(yolp.GeocoderParams{
 		Latitude:  latitude,
@@ -214,8 +328,8 @@ func (app *App) HandleLocation(replyToken string, latitude float64, longitude fl
 		}
 		items, _ := app.searchLocalBooks(areaNames)
 		if len(items) > 0 {
-			return app.replyItemCarousel(replyToken, `"`+strings.Join(areaNames, ", ")+`" の検索結果`, items)
+			return app.replyItemCarousel(delivery, `"`+strings.Join(areaNames, ", ")+`" の検索結果`, items)
 		}
 	}
-	return app.ReplyText(replyToken, "エリアに関連する本は見つかりませんでした。")
+	return app.ReplyText(delivery, "エリアに関連する本は見つかりませんでした。")
 }
@@ -1,14 +1,13 @@
 package app
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/mux"
 	"github.com/line/line-bot-sdk-go/linebot"
 	"github.com/ngs/go-amazon-product-advertising-api/amazon"
@@ -17,179 +16,539 @@ import (
 
 const cartKeyPrefix = "buychat:line:"
 
-func cartClearAction() linebot.TemplateAction {
-	return linebot.NewPostbackTemplateAction("空にする", `{"Action":"`+string(PostbackActionClearCart)+`"}`, "")
+// carouselColumnsMax is the maximum number of columns in a carousel
+const carouselColumnsMax = 5
+
+// cartCarouselsMax is the number of carousels in a show cart reply, leaving
+// room for summary and purchase messages within 5 messages per reply
+const cartCarouselsMax = 3
+
+// CartPolicy configures carts
+type CartPolicy struct {
+	// Capacity is the default number of distinct items in a cart
+	Capacity int
+	// SourceCapacity overrides Capacity for the source type
+	SourceCapacity map[linebot.EventSourceType]int
+	// TTL is the inactivity period after which a cart expires, 0 to keep
+	// carts forever
+	TTL time.Duration
+	// ReminderBefore is how long before expiry a reminder is pushed, 0 to
+	// disable reminders
+	ReminderBefore time.Duration
+	// SweepInterval is the interval of sweeping expiring carts
+	SweepInterval time.Duration
+	// ExpiredRetention is how long expired carts are counted
+	ExpiredRetention time.Duration
+	// AdderOnlyRemoval allows only the user who added an item to remove it
+	// from group and room carts
+	AdderOnlyRemoval bool
+	// ProfileTTL is how long display names of users are cached
+	ProfileTTL time.Duration
+	// LogMax is the number of changes kept in the change log of a cart
+	LogMax int
+	// WishlistCapacity is the number of distinct items in a wishlist
+	WishlistCapacity int
+}
+
+// SetupCartPolicy sets up cart policy
+func (app *App) SetupCartPolicy() error {
+	capacity, err := envInt("CART_CAPACITY", 5)
+	if err != nil {
+		return err
+	}
+	policy := &CartPolicy{Capacity: capacity, SourceCapacity: map[linebot.EventSourceType]int{}}
+	for _, sourceType := range []linebot.EventSourceType{
+		linebot.EventSourceTypeUser,
+		linebot.EventSourceTypeGroup,
+		linebot.EventSourceTypeRoom,
+	} {
+		if policy.SourceCapacity[sourceType], err = envInt("CART_CAPACITY_"+strings.ToUpper(string(sourceType)), capacity); err != nil {
+			return err
+		}
+	}
+	if policy.TTL, err = envDuration("CART_TTL", 30*24*time.Hour); err != nil {
+		return err
+	}
+	if policy.ReminderBefore, err = envDuration("CART_REMINDER_BEFORE", 0); err != nil {
+		return err
+	}
+	if policy.SweepInterval, err = envDuration("CART_SWEEP_INTERVAL", 10*time.Minute); err != nil {
+		return err
+	}
+	if policy.ExpiredRetention, err = envDuration("CART_EXPIRED_RETENTION", 30*24*time.Hour); err != nil {
+		return err
+	}
+	switch removal := os.Getenv("CART_REMOVAL"); removal {
+	case "", "anyone":
+	case "adder":
+		policy.AdderOnlyRemoval = true
+	default:
+		return fmt.Errorf("Invalid CART_REMOVAL: %v", removal)
+	}
+	if policy.ProfileTTL, err = envDuration("PROFILE_CACHE_TTL", 24*time.Hour); err != nil {
+		return err
+	}
+	if policy.LogMax, err = envInt("CART_LOG_MAX", 50); err != nil {
+		return err
+	}
+	if policy.WishlistCapacity, err = envInt("WISHLIST_CAPACITY", 50); err != nil {
+		return err
+	}
+	app.CartPolicy = policy
+	return nil
+}
+
+// cartSourceType returns source type of the cart key
+func cartSourceType(cartKey string) linebot.EventSourceType {
+	return linebot.EventSourceType(strings.SplitN(strings.TrimPrefix(cartKey, cartKeyPrefix), ":", 2)[0])
+}
+
+// CartCapacity returns capacity of the cart
+func (app *App) CartCapacity(cartKey string) int {
+	if capacity, ok := app.CartPolicy.SourceCapacity[cartSourceType(cartKey)]; ok {
+		return capacity
+	}
+	return app.CartPolicy.Capacity
+}
+
+func cartClearAction(encoder *postbackEncoder, cartKey string) linebot.TemplateAction {
+	return encoder.Action("空にする", &PostbackData{Action: PostbackActionClearCart, Cart: cartID(cartKey)})
+}
+
+func showCartAction(encoder *postbackEncoder, cartKey string) linebot.TemplateAction {
+	return encoder.Action("カートを見る", &PostbackData{Action: PostbackActionShowCart, Cart: cartID(cartKey)})
 }
 
 // CartSize returns cart size
 func (app *App) CartSize(cartKey string) (int, error) {
-	app.ReconnectRedisIfNeeeded()
-	return redis.Int(app.RedisConn.Do("LLEN", cartKey))
+	size, err := app.Carts.Size(cartKey)
+	return size, storageError(err)
 }
 
 // ClearCart clears items
 func (app *App) ClearCart(cartKey string) error {
-	app.ReconnectRedisIfNeeeded()
-	return app.RedisConn.Send("DEL", cartKey)
+	if err := app.Carts.Clear(cartKey); err != nil {
+		return storageError(err)
+	}
+	app.markAmazonCartStale(cartKey, true)
+	return app.touchCart(cartKey)
 }
 
 // AddCartItem adds items to cart
-func (app *App) AddCartItem(cartKey string, ASIN string) error {
-	app.ReconnectRedisIfNeeeded()
-	if err := app.RedisConn.Send("LPUSH", cartKey, ASIN); err != nil {
-		return err
+func (app *App) AddCartItem(cartKey string, ASIN string, addedBy string) (CartAddResult, error) {
+	result, err := app.Carts.Add(cartKey, ASIN, addedBy, app.CartCapacity(cartKey))
+	if err != nil {
+		return result, storageError(err)
+	}
+	if result == CartAddResultAdded {
+		app.markAmazonCartStale(cartKey, false)
 	}
-	return app.RedisConn.Flush()
+	return result, app.touchCart(cartKey)
 }
 
 // RemoveCartItem removes items from cart
 func (app *App) RemoveCartItem(cartKey string, ASIN string) error {
-	app.ReconnectRedisIfNeeeded()
-	if err := app.RedisConn.Send("LREM", cartKey, 1, ASIN); err != nil {
-		return err
+	if err := app.Carts.Remove(cartKey, ASIN); err != nil {
+		return storageError(err)
 	}
-	return app.RedisConn.Flush()
+	app.markAmazonCartStale(cartKey, false)
+	return app.touchCart(cartKey)
 }
 
-func (app *App) getCartItems(cartKey string) ([]string, error) {
-	app.ReconnectRedisIfNeeeded()
-	return redis.Strings(app.RedisConn.Do("LRANGE", cartKey, 0, -1))
+// ChangeCartItemQuantity changes quantity of item in cart
+func (app *App) ChangeCartItemQuantity(cartKey string, ASIN string, delta int) (int, error) {
+	quantity, err := app.Carts.ChangeQuantity(cartKey, ASIN, delta)
+	if err != nil {
+		return quantity, storageError(err)
+	}
+	app.markAmazonCartStale(cartKey, false)
+	return quantity, app.touchCart(cartKey)
 }
 
-// HandleCart handles GET /cart/:cartid
-func (app *App) HandleCart(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	cartKey := cartKeyPrefix + params["type"] + ":" + params["id"]
-	res, err := app.getCartItems(cartKey)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+// addedByLabels returns "○○さんが追加" lines for items of shared carts
+func (app *App) addedByLabels(items []CartItem, shared bool) map[string]string {
+	labels := map[string]string{}
+	if !shared {
+		return labels
 	}
-	app.Log.Printf("Cart %v %v", cartKey, res)
-	if len(res) > 0 {
-		app.Log.Printf("%v %v", cartKey, res)
-		params := amazon.CartCreateParameters{}
-		quantities := map[string]int{}
-		for _, asin := range res {
-			quantities[asin]++
+	names := map[string]string{}
+	for _, item := range items {
+		if item.AddedBy == "" {
+			continue
 		}
-		for asin, quantity := range quantities {
-			params.Items.AddASIN(asin, quantity)
+		if _, ok := names[item.AddedBy]; !ok {
+			names[item.AddedBy] = app.DisplayName(item.AddedBy)
 		}
-		retryCount := 0
-		for {
-			res, err := app.Amazon().CartCreate(params).Do()
-			if err != nil {
-				if strings.Contains(err.Error(), requestThrottleError) {
-					if retryCount < retryMax {
-						retryCount++
-						app.Log.Printf("Retrying %d/%d", retryCount, retryMax)
-						time.Sleep(time.Second)
-						continue
-					}
-					http.Error(w, "申し訳ありません、すこし待ってから、もう一度開いてください", 400)
-					return
-				}
-				http.Error(w, err.Error(), 500)
-				rollbar.Error(rollbar.ERR, err)
-				rollbar.Wait()
-				return
-			}
-			http.Redirect(w, r, res.Cart.MobileCartURL, 303)
-			return
+		if name := names[item.AddedBy]; name != "" {
+			labels[item.ASIN] = name + "さんが追加\n"
+		}
+	}
+	return labels
+}
+
+func (app *App) getCartItems(cartKey string) ([]CartItem, error) {
+	items, err := app.Carts.Items(cartKey)
+	return items, storageError(err)
+}
+
+// isSharedCart returns true for group and room carts
+func isSharedCart(cartKey string) bool {
+	return cartSourceType(cartKey) != linebot.EventSourceTypeUser
+}
+
+// removalDeniedBy returns ID of the user who added the item, or any item when
+// ASIN is empty, if the user is not allowed to remove it by CartPolicy
+func (app *App) removalDeniedBy(cartKey string, ASIN string, userID string) (string, error) {
+	if !app.CartPolicy.AdderOnlyRemoval || !isSharedCart(cartKey) {
+		return "", nil
+	}
+	items, err := app.getCartItems(cartKey)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range items {
+		if (ASIN == "" || item.ASIN == ASIN) && item.AddedBy != "" && item.AddedBy != userID {
+			return item.AddedBy, nil
 		}
+	}
+	return "", nil
+}
+
+// replyRemovalDenied replies that items added by the user can't be removed
+func (app *App) replyRemovalDenied(delivery *Delivery, addedBy string) error {
+	name := app.DisplayName(addedBy)
+	if name == "" {
+		name = "ほかの人"
 	} else {
-		http.Error(w, "カートにまだ何も追加されていません", 404)
+		name += "さん"
+	}
+	return app.ReplyText(delivery, name+"が追加した商品は、追加した人だけが削除できます")
+}
+
+// HandleCart handles GET /cart/{type}/{id}, which is accepted until
+// CheckoutPolicy.LegacyUntil
+func (app *App) HandleCart(w http.ResponseWriter, r *http.Request) {
+	if !time.Now().Before(app.Checkout.LegacyUntil) {
+		http.Error(w, "このリンクは無効か、有効期限が切れています。もう一度カートを表示してください", 403)
+		return
+	}
+	params := mux.Vars(r)
+	app.redirectToAmazonCart(w, r, cartKeyPrefix+params["type"]+":"+params["id"])
+}
+
+func (app *App) redirectToAmazonCart(w http.ResponseWriter, r *http.Request, cartKey string) {
+	cart, err := app.GetAmazonCart(cartKey)
+	if err != nil {
+		app.Log.Printf("Got error %v %v", err, cartKey)
+		http.Error(w, ErrorMessage(err), ErrorStatus(err))
+		if shouldReportError(err) {
+			rollbar.Error(rollbar.ERR, err)
+			rollbar.Wait()
+		}
+		return
+	}
+	if cart == nil {
+		http.Error(w, app.cartLabel(cartKey)+"にまだ何も追加されていません", 404)
+		return
 	}
+	app.Log.Printf("Cart %v %v", cartKey, cart.ID)
+	http.Redirect(w, r, cart.MobileCartURL, 303)
 }
 
 // HandleAddCart handles add cart
-func (app *App) HandleAddCart(replyToken string, data PostbackData, cartKey string) error {
-	size, err := app.CartSize(cartKey)
-	cartURL := os.Getenv("HTTP_BASE") + "/cart/" +
-		strings.Replace(strings.Replace(cartKey, cartKeyPrefix, "", 1), ":", "/", 1)
-	cartURLAction := linebot.NewURITemplateAction("購入する", cartURL)
-	cartShowAction := linebot.NewPostbackTemplateAction("カートを見る", `{"Action":"`+string(PostbackActionShowCart)+`"}`, "")
+func (app *App) HandleAddCart(delivery *Delivery, data PostbackData, cartKey string) error {
+	delivery.MarkChanged()
+	result, err := app.AddCartItem(cartKey, data.ASIN, delivery.UserID)
+	if err != nil {
+		return err
+	}
+	cartURL, err := app.CartURL(cartKey)
 	if err != nil {
 		return err
 	}
-	if size >= 5 {
-		_, err = app.Line.ReplyMessage(replyToken, linebot.NewTemplateMessage("カートが一杯です",
-			linebot.NewButtonsTemplate("", "カートが一杯です", "Amazon のカートに追加するか、空にしてください",
+	cartURLAction := linebot.NewURITemplateAction("購入する", cartURL)
+	encoder := &postbackEncoder{app: app}
+	cartShowAction := showCartAction(encoder, cartKey)
+	label := app.cartLabel(cartKey)
+	switch result {
+	case CartAddResultFull:
+		err = app.Reply(delivery, linebot.NewTemplateMessage(label+"が一杯です",
+			linebot.NewButtonsTemplate("", truncateRunes(label+"が一杯です (最大"+strconv.Itoa(app.CartCapacity(cartKey))+"点)", 40), "Amazon のカートに追加するか、空にしてください",
 				cartURLAction,
 				cartShowAction,
-				cartClearAction(),
-			))).Do()
+				cartClearAction(encoder, cartKey),
+			)))
 		return err
-	}
-	if err = app.AddCartItem(cartKey, data.ASIN); err != nil {
+	case CartAddResultDuplicate:
+		err = app.Reply(delivery, linebot.NewTemplateMessage("すでに"+label+"に入っています: "+data.Title,
+			linebot.NewButtonsTemplate(data.ImageURL, data.Title, "すでに"+label+"に入っています", cartShowAction, cartURLAction)))
 		return err
 	}
-	msg1 := linebot.NewTextMessage(`カートに追加しました`)
-	msg2 := linebot.NewTemplateMessage("カートに追加しました: "+data.Title,
-		linebot.NewButtonsTemplate(data.ImageURL, data.Title, data.Label, cartShowAction, cartURLAction))
-	_, err = app.Line.ReplyMessage(replyToken, msg1, msg2).Do()
+	changeID := app.recordCartChange(cartKey, &CartChange{
+		Action: CartChangeAdd,
+		ASIN:   data.ASIN,
+		Title:  data.Title,
+		UserID: delivery.UserID,
+	})
+	actions := []linebot.TemplateAction{cartShowAction, cartURLAction}
+	if changeID != "" {
+		actions = append(actions, undoCartAction(encoder, cartKey, changeID))
+	}
+	msg1 := linebot.NewTextMessage(label + "に追加しました")
+	msg2 := linebot.NewTemplateMessage(label+"に追加しました: "+data.Title,
+		linebot.NewButtonsTemplate(data.ImageURL, data.Title, data.Label, actions...))
+	if encoder.err != nil {
+		return encoder.err
+	}
+	err = app.Reply(delivery, msg1, msg2)
 	return err
 }
 
 // HandleClearCart handles clear cart
-func (app *App) HandleClearCart(replyToken string, cartKey string) error {
+func (app *App) HandleClearCart(delivery *Delivery, cartKey string) error {
+	if addedBy, err := app.removalDeniedBy(cartKey, "", delivery.UserID); err != nil {
+		return err
+	} else if addedBy != "" {
+		return app.replyRemovalDenied(delivery, addedBy)
+	}
+	items, err := app.getCartItems(cartKey)
+	if err != nil {
+		return err
+	}
+	delivery.MarkChanged()
 	if err := app.ClearCart(cartKey); err != nil {
 		return err
 	}
-	msg1 := linebot.NewTextMessage(`カートを空にしました`)
-	_, err := app.Line.ReplyMessage(replyToken, msg1).Do()
-	return err
+	if len(items) == 0 {
+		return app.ReplyText(delivery, app.cartLabel(cartKey)+"を空にしました")
+	}
+	changeID := app.recordCartChange(cartKey, &CartChange{
+		Action: CartChangeClear,
+		Items:  items,
+		UserID: delivery.UserID,
+	})
+	return app.replyCartChanged(delivery, cartKey, app.cartLabel(cartKey)+"を空にしました", changeID)
 }
 
 // HandleShowCart handles show cart
-func (app *App) HandleShowCart(replyToken string, cartKey string) error {
-	ids, err := app.getCartItems(cartKey)
+func (app *App) HandleShowCart(delivery *Delivery, cartKey string) error {
+	return app.HandleShowCartPage(delivery, cartKey, 0)
+}
+
+// HandleShowCartPage handles show cart, showing up to 3 carousels from page.
+// Only items on the page are looked up, except on the first page which shows
+// the estimate of the whole cart.
+func (app *App) HandleShowCartPage(delivery *Delivery, cartKey string, page int) error {
+	cartItems, err := app.getCartItems(cartKey)
 	if err != nil {
 		return err
 	}
-	if len(ids) == 0 {
-		return app.ReplyText(replyToken, "カートに何もはいっていません")
+	if len(cartItems) == 0 {
+		return app.ReplyText(delivery, app.cartLabel(cartKey)+"に何もはいっていません")
 	}
-	items, err := app.lookupItems(ids)
-	if err != nil {
-		if strings.Contains(err.Error(), requestThrottleError) {
-			return app.ReplyText(replyToken, "申し訳ありません、すこし待ってから、もう一度送信してださい")
+	ids := []string{}
+	quantities := map[string]int{}
+	addedBy := app.addedByLabels(cartItems, isSharedCart(cartKey))
+	total := 0
+	for _, item := range cartItems {
+		ids = append(ids, item.ASIN)
+		quantities[item.ASIN] = item.Quantity
+		total += item.Quantity
+	}
+	start, end := pageRange(len(ids), page)
+	more := end < len(ids)
+	summary := app.cartLabel(cartKey) + "に " + strconv.Itoa(total) + "個の商品が入っています"
+	var items []amazon.Item
+	if page == 0 {
+		allItems, err := app.lookupItems(ids)
+		if err != nil {
+			return err
+		}
+		summary += "\n" + estimateCart(allItems, quantities).String()
+		if cart, err := app.GetAmazonCart(cartKey); err != nil {
+			app.Log.Printf("Failed to get Amazon cart %v %v", err, cartKey)
+		} else if cart != nil && cart.SubTotal.FormattedPrice != "" {
+			summary += "\nAmazon での小計: " + cart.SubTotal.FormattedPrice
+		}
+		items = itemsWithASINs(allItems, ids[start:end])
+	} else if start < end {
+		if items, err = app.lookupItems(ids[start:end]); err != nil {
+			return err
 		}
-		return err
 	}
-	template := getAmazonItemCarousel(items,
+	encoder := &postbackEncoder{app: app}
+	messages, _ := pagedItemCarousels(items, 0, "カートの内容",
+		func(item amazon.Item, label string) string {
+			quantity := quantities[item.ASIN]
+			amount, currency, ok := itemPrice(item)
+			if !ok {
+				return addedBy[item.ASIN] + "×" + strconv.Itoa(quantity) + " 価格不明 / " + label
+			}
+			return addedBy[item.ASIN] + "×" + strconv.Itoa(quantity) + " 計 " + formatPrice(amount*quantity, currency) + " / " + label
+		},
 		func(item amazon.Item, imgURL string, label string, title string) []linebot.TemplateAction {
-			postbackData := &PostbackData{
-				Action: PostbackActionRemoveCart,
-				ASIN:   item.ASIN,
-				Title:  title,
+			postbackData := func(action PostbackAction) string {
+				return encoder.Encode(&PostbackData{
+					Action:   action,
+					ASIN:     item.ASIN,
+					ImageURL: imgURL,
+					Label:    label,
+					Title:    title,
+					Cart:     cartID(cartKey),
+				})
 			}
-			bytes, _ := json.Marshal(postbackData)
 			return []linebot.TemplateAction{
-				linebot.NewPostbackTemplateAction("カートから削除", string(bytes), ""),
+				linebot.NewPostbackTemplateAction("数量を変更", postbackData(PostbackActionCartItemMenu), ""),
+				linebot.NewPostbackTemplateAction("カートから削除", postbackData(PostbackActionRemoveCart), ""),
 				linebot.NewURITemplateAction("Amazon で見る", item.DetailPageURL),
 			}
 		})
-	cartURL := os.Getenv("HTTP_BASE") + "/cart/" +
-		strings.Replace(strings.Replace(cartKey, cartKeyPrefix, "", 1), ":", "/", 1)
-	msg1 := linebot.NewTextMessage("カートに " + strconv.Itoa(len(ids)) + "個の商品が入っています")
-	msg2 := linebot.NewTemplateMessage("カートの内容", template)
-	msg3 := linebot.NewTemplateMessage("Amazon で購入しますか？",
-		linebot.NewConfirmTemplate("Amazon で購入しますか？",
-			linebot.NewURITemplateAction("購入する", cartURL),
-			cartClearAction(),
+	cartURL, err := app.CartURL(cartKey)
+	if err != nil {
+		return err
+	}
+	if page > 0 || more {
+		summary += "\n(" + strconv.Itoa(page+1) + "ページ目)"
+	}
+	purchaseAction := linebot.NewURITemplateAction("購入する", cartURL)
+	var purchase linebot.Message
+	if more {
+		purchase = linebot.NewTemplateMessage("Amazon で購入しますか？",
+			linebot.NewButtonsTemplate("", "", "Amazon で購入しますか？",
+				purchaseAction,
+				cartClearAction(encoder, cartKey),
+				encoder.Action("次のページ", &PostbackData{Action: PostbackActionShowCart, Page: page + 1, Cart: cartID(cartKey)}),
+			))
+	} else {
+		purchase = linebot.NewTemplateMessage("Amazon で購入しますか？",
+			linebot.NewConfirmTemplate("Amazon で購入しますか？",
+				purchaseAction,
+				cartClearAction(encoder, cartKey),
+			))
+	}
+	if encoder.err != nil {
+		return encoder.err
+	}
+	messages = append([]linebot.Message{linebot.NewTextMessage(summary)}, messages...)
+	messages = append(messages, purchase)
+	return app.Reply(delivery, messages...)
+}
+
+// HandleCartItemMenu replies buttons to change quantity of the cart item or
+// move it to the wishlist, which do not fit in the cart carousel
+func (app *App) HandleCartItemMenu(delivery *Delivery, data PostbackData, cartKey string) error {
+	item, err := app.getCartItem(cartKey, data.ASIN)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return app.ReplyText(delivery, app.cartLabel(cartKey)+"に入っていません: "+data.Title)
+	}
+	encoder := &postbackEncoder{app: app}
+	action := func(label string, action PostbackAction) linebot.TemplateAction {
+		next := data
+		next.Action = action
+		return encoder.Action(label, &next)
+	}
+	msg := linebot.NewTemplateMessage(data.Title,
+		linebot.NewButtonsTemplate(data.ImageURL, data.Title, "数量: "+strconv.Itoa(item.Quantity),
+			action("1つ増やす", PostbackActionIncreaseQuantity),
+			action("1つ減らす", PostbackActionDecreaseQuantity),
+			action("ほしいものリストに移す", PostbackActionMoveToWishlist),
+			showCartAction(encoder, cartKey),
 		))
-	json, _ := msg2.MarshalJSON()
-	app.Log.Println(string(json))
-	_, err = app.Line.ReplyMessage(replyToken, msg1, msg2, msg3).Do()
-	return nil
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return app.Reply(delivery, msg)
 }
 
 // HandleRemoveCart handles remove cart
-func (app *App) HandleRemoveCart(replyToken string, data PostbackData, cartKey string) error {
+func (app *App) HandleRemoveCart(delivery *Delivery, data PostbackData, cartKey string) error {
+	if addedBy, err := app.removalDeniedBy(cartKey, data.ASIN, delivery.UserID); err != nil {
+		return err
+	} else if addedBy != "" {
+		return app.replyRemovalDenied(delivery, addedBy)
+	}
+	item, err := app.getCartItem(cartKey, data.ASIN)
+	if err != nil {
+		return err
+	}
+	delivery.MarkChanged()
 	if err := app.RemoveCartItem(cartKey, data.ASIN); err != nil {
 		return err
 	}
-	return app.ReplyText(replyToken, "カートから削除しました: "+data.Title)
+	if item == nil {
+		return app.ReplyText(delivery, app.cartLabel(cartKey)+"から削除しました: "+data.Title)
+	}
+	changeID := app.recordCartChange(cartKey, &CartChange{
+		Action: CartChangeRemove,
+		ASIN:   data.ASIN,
+		Title:  data.Title,
+		Items:  []CartItem{*item},
+		UserID: delivery.UserID,
+	})
+	text := app.cartLabel(cartKey) + "から削除しました: " + data.Title
+	encoder := &postbackEncoder{app: app}
+	actions := []linebot.TemplateAction{addWishlistAction(encoder, &data)}
+	if changeID != "" {
+		actions = append(actions, undoCartAction(encoder, cartKey, changeID))
+	}
+	msg := linebot.NewTemplateMessage(text,
+		linebot.NewButtonsTemplate("", "", truncateRunes(text, 160), actions...))
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return app.Reply(delivery, msg)
+}
+
+// replyCartChanged replies text with "元に戻す" button for the change
+func (app *App) replyCartChanged(delivery *Delivery, cartKey string, text string, changeID string) error {
+	if changeID == "" {
+		return app.ReplyText(delivery, text)
+	}
+	encoder := &postbackEncoder{app: app}
+	msg := linebot.NewTemplateMessage(text,
+		linebot.NewButtonsTemplate("", "", truncateRunes(text, 160), undoCartAction(encoder, cartKey, changeID)))
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return app.Reply(delivery, msg)
+}
+
+// HandleChangeQuantity handles quantity change of item in cart
+func (app *App) HandleChangeQuantity(delivery *Delivery, data PostbackData, cartKey string, delta int) error {
+	if delta < 0 {
+		if addedBy, err := app.removalDeniedBy(cartKey, data.ASIN, delivery.UserID); err != nil {
+			return err
+		} else if addedBy != "" {
+			return app.replyRemovalDenied(delivery, addedBy)
+		}
+	}
+	item, err := app.getCartItem(cartKey, data.ASIN)
+	if err != nil {
+		return err
+	}
+	delivery.MarkChanged()
+	quantity, err := app.ChangeCartItemQuantity(cartKey, data.ASIN, delta)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return app.ReplyText(delivery, "この商品は"+app.cartLabel(cartKey)+"に入っていません: "+data.Title)
+	}
+	change := &CartChange{
+		Action: CartChangeQuantity,
+		ASIN:   data.ASIN,
+		Title:  data.Title,
+		Delta:  delta,
+		UserID: delivery.UserID,
+	}
+	if quantity == 0 {
+		change.Action = CartChangeRemove
+		change.Delta = 0
+		change.Items = []CartItem{*item}
+		return app.replyCartChanged(delivery, cartKey, app.cartLabel(cartKey)+"から削除しました: "+data.Title, app.recordCartChange(cartKey, change))
+	}
+	return app.replyCartChanged(delivery, cartKey, "数量を変更しました: "+data.Title+" ×"+strconv.Itoa(quantity), app.recordCartChange(cartKey, change))
 }
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/stvp/rollbar"
+)
+
+const cartReminderKeyPrefix = "buychat:cart-reminder:"
+
+// touchCart refreshes expiry of the cart after a change, and forgets remote
+// cart of the previous contents when the cart had already expired
+func (app *App) touchCart(cartKey string) error {
+	if app.CartPolicy.TTL == 0 {
+		return nil
+	}
+	expired, err := app.Carts.Touch(cartKey, time.Now().Add(app.CartPolicy.TTL))
+	if err != nil {
+		return storageError(err)
+	}
+	if expired {
+		app.dropAmazonCart(cartKey)
+	}
+	return nil
+}
+
+// indexExistingCarts gives carts which never expired an expiry of TTL from
+// now, so that carts created before expiry was enabled are swept as well
+func (app *App) indexExistingCarts() error {
+	store, ok := app.Carts.(*RedisCartStore)
+	if !ok || app.CartPolicy.TTL == 0 {
+		return nil
+	}
+	indexed, err := store.IndexCarts(time.Now().Add(app.CartPolicy.TTL))
+	if err != nil {
+		return err
+	}
+	if indexed > 0 {
+		app.Log.Printf("Set expiry of %d existing carts", indexed)
+	}
+	return nil
+}
+
+// cartSourceID returns user, group or room ID of the cart key
+func cartSourceID(cartKey string) string {
+	parts := strings.SplitN(strings.TrimPrefix(cartKey, cartKeyPrefix), ":", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// StartCartSweeper starts sweeping expiring carts in background
+func (app *App) StartCartSweeper() {
+	if app.CartPolicy.TTL == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(app.CartPolicy.SweepInterval) {
+			if err := app.SweepCarts(time.Now()); err != nil {
+				app.Log.Printf("Failed to sweep carts %v", err)
+				rollbar.Error(rollbar.ERR, err)
+			}
+		}
+	}()
+}
+
+// SweepCarts expires carts which expired by now, and reminds carts which
+// expire within CartPolicy.ReminderBefore
+func (app *App) SweepCarts(now time.Time) error {
+	expiries, err := app.Carts.Expiring(now.Add(app.CartPolicy.ReminderBefore))
+	if err != nil {
+		return storageError(err)
+	}
+	for _, expiry := range expiries {
+		if expiry.ExpiresAt.After(now) {
+			app.remindCart(expiry, now)
+			continue
+		}
+		expired, err := app.Carts.Expire(expiry)
+		if err != nil {
+			return storageError(err)
+		}
+		if expired {
+			app.Log.Printf("Cart expired %v", expiry.CartKey)
+			app.dropAmazonCart(expiry.CartKey)
+			if err := app.Store.Del(cartLogKey(expiry.CartKey)); err != nil {
+				app.Log.Printf("Failed to drop cart log %v %v", err, expiry.CartKey)
+			}
+		}
+	}
+	return storageError(app.Carts.PruneExpired(now.Add(-app.CartPolicy.ExpiredRetention)))
+}
+
+// remindCart pushes a reminder once per expiry of a non-empty cart
+func (app *App) remindCart(expiry CartExpiry, now time.Time) {
+	to := cartSourceID(expiry.CartKey)
+	if to == "" {
+		return
+	}
+	size, err := app.CartSize(expiry.CartKey)
+	if err != nil || size == 0 {
+		return
+	}
+	key := cartReminderKeyPrefix + expiry.CartKey + ":" + strconv.FormatInt(expiry.ExpiresAt.Unix(), 10)
+	if ok, err := app.Store.SetNX(key, "1", expiry.ExpiresAt.Sub(now)+app.CartPolicy.SweepInterval); err != nil || !ok {
+		return
+	}
+	encoder := &postbackEncoder{app: app}
+	hours := int(expiry.ExpiresAt.Sub(now)/time.Hour) + 1
+	label := app.cartLabel(expiry.CartKey)
+	text := label + "に商品が残っています\nあと約" + strconv.Itoa(hours) + "時間で" + label + "が空になります"
+	msg := linebot.NewTemplateMessage("カートに商品が残っています",
+		linebot.NewButtonsTemplate("", "", truncateRunes(text, 160), showCartAction(encoder, expiry.CartKey)))
+	if encoder.err != nil {
+		app.Log.Printf("Failed to remind cart %v %v", encoder.err, expiry.CartKey)
+		return
+	}
+	if _, err := app.Line.PushMessage(to, msg).Do(); err != nil {
+		app.Log.Printf("Failed to remind cart %v %v", err, expiry.CartKey)
+		return
+	}
+	app.Log.Printf("Reminded cart %v", expiry.CartKey)
+}
+
+// HandleAdminCarts handles GET /admin/carts, which responds numbers of active
+// and expired carts to requests with ADMIN_TOKEN
+func (app *App) HandleAdminCarts(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if app.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(app.AdminToken)) != 1 {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	count, err := app.Carts.Count(time.Now())
+	if err != nil {
+		app.Log.Printf("Failed to count carts %v", err)
+		http.Error(w, ErrorMessage(storageError(err)), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&count)
+}
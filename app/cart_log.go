@@ -0,0 +1,283 @@
+package app
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+const cartLogKeyPrefix = "buychat:cart-log:"
+
+const cartUndoKeyPrefix = "buychat:cart-undo:"
+
+// cartUndoClaimTTL is how long undone changes are remembered, so that they
+// are never undone twice
+const cartUndoClaimTTL = 30 * 24 * time.Hour
+
+// cartHistoryDefault is the number of changes shown without count
+const cartHistoryDefault = 10
+
+// CartChangeAction represents kind of change to cart
+type CartChangeAction string
+
+const (
+	// CartChangeAdd an item was added
+	CartChangeAdd CartChangeAction = "add"
+	// CartChangeRemove items were removed
+	CartChangeRemove CartChangeAction = "remove"
+	// CartChangeQuantity quantity of an item was changed
+	CartChangeQuantity CartChangeAction = "quantity"
+	// CartChangeClear the cart was cleared
+	CartChangeClear CartChangeAction = "clear"
+	// CartChangeUndo a change was reversed
+	CartChangeUndo CartChangeAction = "undo"
+)
+
+// CartChange is an entry of append-only change log of a cart
+type CartChange struct {
+	ID     string
+	Action CartChangeAction
+	ASIN   string `json:",omitempty"`
+	Title  string `json:",omitempty"`
+	Delta  int    `json:",omitempty"`
+	// Items are the items removed by the change
+	Items  []CartItem `json:",omitempty"`
+	Undoes string     `json:",omitempty"`
+	UserID string     `json:",omitempty"`
+	At     time.Time
+}
+
+var cartLogLocation = time.FixedZone("JST", 9*60*60)
+
+func cartLogKey(cartKey string) string {
+	return cartLogKeyPrefix + cartKey
+}
+
+// recordCartChange appends the change to the cart log and returns its ID, or
+// empty string when it failed
+func (app *App) recordCartChange(cartKey string, change *CartChange) string {
+	change.At = time.Now()
+	change.ID = strconv.FormatInt(change.At.UnixNano(), 36)
+	data, _ := json.Marshal(change)
+	if err := app.Store.PushList(cartLogKey(cartKey), string(data), app.CartPolicy.LogMax); err != nil {
+		app.Log.Printf("Failed to record cart change %v %v", err, cartKey)
+		return ""
+	}
+	return change.ID
+}
+
+// CartChanges returns last n changes of the cart, newest first
+func (app *App) CartChanges(cartKey string, n int) ([]CartChange, error) {
+	values, err := app.Store.List(cartLogKey(cartKey), n)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	changes := []CartChange{}
+	for _, value := range values {
+		var change CartChange
+		if err := json.Unmarshal([]byte(value), &change); err != nil {
+			app.Log.Printf("Skipped broken cart change %v %v", err, value)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// lastCartChange returns the latest change which is not undone yet
+func (app *App) lastCartChange(cartKey string) (*CartChange, error) {
+	changes, err := app.CartChanges(cartKey, app.CartPolicy.LogMax)
+	if err != nil {
+		return nil, err
+	}
+	undone := map[string]bool{}
+	for _, change := range changes {
+		if change.Action == CartChangeUndo {
+			undone[change.Undoes] = true
+			continue
+		}
+		if !undone[change.ID] {
+			return &change, nil
+		}
+	}
+	return nil, nil
+}
+
+func (app *App) getCartItem(cartKey string, ASIN string) (*CartItem, error) {
+	items, err := app.getCartItems(cartKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.ASIN == ASIN {
+			return &item, nil
+		}
+	}
+	return nil, nil
+}
+
+// restoreCartItem puts back the item within capacity of the cart, keeping
+// items added since then, and returns false when the cart is full
+func (app *App) restoreCartItem(cartKey string, item CartItem) (bool, error) {
+	result, err := app.Carts.Add(cartKey, item.ASIN, item.AddedBy, app.CartCapacity(cartKey))
+	if err != nil {
+		return false, storageError(err)
+	}
+	if result == CartAddResultAdded && item.Quantity > 1 {
+		if _, err := app.Carts.ChangeQuantity(cartKey, item.ASIN, item.Quantity-1); err != nil {
+			return false, storageError(err)
+		}
+	}
+	return result != CartAddResultFull, nil
+}
+
+// claimCartUndo records the change as undone and returns false if it was
+// already claimed
+func (app *App) claimCartUndo(cartKey string, changeID string) (bool, error) {
+	claimed, err := app.Store.SetNX(cartUndoKeyPrefix+cartKey+":"+changeID, time.Now().Format(time.RFC3339), cartUndoClaimTTL)
+	if err != nil {
+		return false, storageError(err)
+	}
+	return claimed, nil
+}
+
+func undoCartAction(encoder *postbackEncoder, cartKey string, changeID string) linebot.TemplateAction {
+	return encoder.Action("元に戻す", &PostbackData{Action: PostbackActionUndoCart, ChangeID: changeID, Cart: cartID(cartKey)})
+}
+
+// HandleUndoCart reverses the last change of the cart, or does nothing when
+// the change is not the last one anymore
+func (app *App) HandleUndoCart(delivery *Delivery, data PostbackData, cartKey string) error {
+	change, err := app.lastCartChange(cartKey)
+	if err != nil {
+		return err
+	}
+	if change == nil {
+		return app.ReplyText(delivery, "元に戻せる変更はありません")
+	}
+	if data.ChangeID != "" && data.ChangeID != change.ID {
+		return app.ReplyText(delivery, "このあとにカートが変更されたため、元に戻せません")
+	}
+	if change.Action == CartChangeAdd {
+		if addedBy, err := app.removalDeniedBy(cartKey, change.ASIN, delivery.UserID); err != nil {
+			return err
+		} else if addedBy != "" {
+			return app.replyRemovalDenied(delivery, addedBy)
+		}
+	}
+	delivery.MarkChanged()
+	if claimed, err := app.claimCartUndo(cartKey, change.ID); err != nil {
+		return err
+	} else if !claimed {
+		return app.ReplyText(delivery, "この変更はすでに元に戻しました")
+	}
+	skipped := 0
+	switch change.Action {
+	case CartChangeAdd:
+		err = app.RemoveCartItem(cartKey, change.ASIN)
+	case CartChangeQuantity:
+		_, err = app.ChangeCartItemQuantity(cartKey, change.ASIN, -change.Delta)
+	case CartChangeRemove, CartChangeClear:
+		for _, item := range change.Items {
+			var restored bool
+			if restored, err = app.restoreCartItem(cartKey, item); err != nil {
+				break
+			} else if !restored {
+				skipped++
+			}
+		}
+		if err == nil {
+			err = app.touchCart(cartKey)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	app.markAmazonCartStale(cartKey, false)
+	app.recordCartChange(cartKey, &CartChange{
+		Action: CartChangeUndo,
+		Undoes: change.ID,
+		Title:  describeCartChange(change),
+		UserID: delivery.UserID,
+	})
+	text := "元に戻しました: " + describeCartChange(change)
+	if skipped > 0 {
+		text = "カートが一杯のため " + strconv.Itoa(skipped) + "点は戻せませんでした\n" + text
+	}
+	encoder := &postbackEncoder{app: app}
+	msg := linebot.NewTemplateMessage("元に戻しました",
+		linebot.NewButtonsTemplate("", "", truncateRunes(text, 160),
+			showCartAction(encoder, cartKey)))
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return app.Reply(delivery, msg)
+}
+
+// describeCartChange returns description of the change without who did it
+func describeCartChange(change *CartChange) string {
+	switch change.Action {
+	case CartChangeAdd:
+		return "追加 " + change.Title
+	case CartChangeRemove:
+		return "削除 " + change.Title
+	case CartChangeQuantity:
+		if change.Delta > 0 {
+			return "数量+" + strconv.Itoa(change.Delta) + " " + change.Title
+		}
+		return "数量" + strconv.Itoa(change.Delta) + " " + change.Title
+	case CartChangeClear:
+		return "空にする (" + strconv.Itoa(len(change.Items)) + "点)"
+	case CartChangeUndo:
+		return "元に戻す (" + change.Title + ")"
+	}
+	return string(change.Action)
+}
+
+// HandleCartHistory replies last n changes of the cart
+func (app *App) HandleCartHistory(delivery *Delivery, cartKey string, n int) error {
+	if n <= 0 {
+		n = cartHistoryDefault
+	}
+	if n > app.CartPolicy.LogMax {
+		n = app.CartPolicy.LogMax
+	}
+	changes, err := app.CartChanges(cartKey, n)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return app.ReplyText(delivery, app.cartLabel(cartKey)+"の変更履歴はありません")
+	}
+	text := app.cartLabel(cartKey) + "の変更履歴 (新しい順)"
+	names := map[string]string{}
+	for _, change := range changes {
+		line := "\n" + change.At.In(cartLogLocation).Format("01/02 15:04") + " "
+		if change.UserID != "" && isSharedCart(cartKey) {
+			if _, ok := names[change.UserID]; !ok {
+				names[change.UserID] = app.DisplayName(change.UserID)
+			}
+			if name := names[change.UserID]; name != "" {
+				line += name + "さん: "
+			}
+		}
+		text += line + describeCartChange(&change)
+	}
+	encoder := &postbackEncoder{app: app}
+	msg := linebot.NewTemplateMessage("カートの変更を元に戻しますか？",
+		linebot.NewButtonsTemplate("", "", "最後の変更を元に戻しますか？",
+			undoCartAction(encoder, cartKey, "")))
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return app.Reply(delivery, linebot.NewTextMessage(truncateRunes(text, 2000)), msg)
+}
+
+func truncateRunes(text string, max int) string {
+	if runes := []rune(text); len(runes) > max {
+		return string(runes[0:max])
+	}
+	return text
+}
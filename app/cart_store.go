@@ -0,0 +1,94 @@
+package app
+
+import (
+	"os"
+	"time"
+)
+
+// CartAddResult represents result of adding an item to cart
+type CartAddResult string
+
+const (
+	// CartAddResultAdded the item was added
+	CartAddResultAdded CartAddResult = "added"
+	// CartAddResultFull the cart has no room for the item
+	CartAddResultFull CartAddResult = "full"
+	// CartAddResultDuplicate the item is already in the cart
+	CartAddResultDuplicate CartAddResult = "duplicate"
+)
+
+// CartItem represents an item in cart
+type CartItem struct {
+	ASIN     string
+	Quantity int
+	// AddedBy is ID of the user who added the item, empty when unknown
+	AddedBy string
+}
+
+// CartExpiry represents expiry of a cart recorded in the cart index
+type CartExpiry struct {
+	CartKey   string
+	ExpiresAt time.Time
+}
+
+// CartCount represents numbers of carts in the cart index
+type CartCount struct {
+	Active  int `json:"active"`
+	Expired int `json:"expired"`
+}
+
+// CartStore stores ASINs and their quantities in carts identified by cart key
+type CartStore interface {
+	// Size returns number of distinct items in the cart
+	Size(cartKey string) (int, error)
+	// Clear removes all items from the cart
+	Clear(cartKey string) error
+	// Add atomically adds an item with quantity 1 added by the user to the
+	// cart unless the cart already has capacity items or contains the item
+	Add(cartKey string, ASIN string, addedBy string, capacity int) (CartAddResult, error)
+	// Remove removes the item from the cart
+	Remove(cartKey string, ASIN string) error
+	// ChangeQuantity adds delta to quantity of the item in the cart and returns
+	// new quantity. The item is removed when quantity drops to zero, and
+	// nothing happens when the item is not in the cart.
+	ChangeQuantity(cartKey string, ASIN string, delta int) (int, error)
+	// Items returns items in the cart
+	Items(cartKey string) ([]CartItem, error)
+	// Touch makes the cart expire at expiresAt and records it in the cart
+	// index, or removes the cart from the index when it is empty. It returns
+	// true when the previous expiry had already passed.
+	Touch(cartKey string, expiresAt time.Time) (bool, error)
+	// Expiring returns carts in the index expiring before t
+	Expiring(t time.Time) ([]CartExpiry, error)
+	// Expire moves the cart to the expired index unless it was touched after
+	// Expiring returned expiry, and returns true when it was moved
+	Expire(expiry CartExpiry) (bool, error)
+	// Count returns numbers of active and expired carts at t
+	Count(t time.Time) (CartCount, error)
+	// PruneExpired removes carts expired before t from the expired index
+	PruneExpired(t time.Time) error
+}
+
+// SetupCartStore sets up cart store and state store specified with CART_STORE
+func (app *App) SetupCartStore() error {
+	switch os.Getenv("CART_STORE") {
+	case "memory":
+		app.Carts = NewMemoryCartStore()
+		app.Store = NewMemoryStore()
+		return nil
+	}
+	if err := app.SetupRedis(); err != nil {
+		return err
+	}
+	store := &RedisCartStore{Pool: app.RedisPool}
+	migrated, err := store.MigrateListCarts()
+	if err != nil {
+		return err
+	}
+	if migrated > 0 {
+		app.Log.Printf("Migrated %d list carts", migrated)
+	}
+	app.Carts = store
+	app.Store = &RedisStore{Pool: app.RedisPool}
+	return nil
+}
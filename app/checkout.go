@@ -0,0 +1,68 @@
+package app
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const checkoutKeyPrefix = "buychat:checkout:"
+
+const checkoutLegacyUntilKey = "buychat:checkout-legacy-until"
+
+// CheckoutPolicy configures checkout URLs
+type CheckoutPolicy struct {
+	// TTL is how long checkout URLs are valid
+	TTL time.Duration
+	// LegacyUntil is when /cart/{type}/{id} URLs stop working
+	LegacyUntil time.Time
+}
+
+// SetupCheckout sets up checkout policy. Unless CHECKOUT_LEGACY_UNTIL is set,
+// legacy URLs work for CHECKOUT_LEGACY_WINDOW from the first start with
+// checkout URLs.
+func (app *App) SetupCheckout() error {
+	ttl, err := envDuration("CHECKOUT_URL_TTL", 24*time.Hour)
+	if err != nil {
+		return err
+	}
+	policy := &CheckoutPolicy{TTL: ttl}
+	policy.LegacyUntil, err = app.envDeadline("CHECKOUT_LEGACY_UNTIL", "CHECKOUT_LEGACY_WINDOW", 30*24*time.Hour, checkoutLegacyUntilKey)
+	if err != nil {
+		return err
+	}
+	app.Log.Printf("Legacy cart URLs work until %v", policy.LegacyUntil.Format(time.RFC3339))
+	app.Checkout = policy
+	return nil
+}
+
+// CartURL returns new checkout URL for the cart, which expires after TTL
+func (app *App) CartURL(cartKey string) (string, error) {
+	slug, err := newRandomToken(18)
+	if err != nil {
+		return "", err
+	}
+	if err := app.Store.Set(checkoutKeyPrefix+slug, cartKey, app.Checkout.TTL); err != nil {
+		return "", storageError(err)
+	}
+	return os.Getenv("HTTP_BASE") + "/cart/" + slug, nil
+}
+
+// HandleCheckout handles GET /cart/{slug}
+func (app *App) HandleCheckout(w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+	cartKey, ok, err := app.Store.Get(checkoutKeyPrefix + slug)
+	if err != nil {
+		err = storageError(err)
+		app.Log.Printf("Got error %v %v", err, slug)
+		http.Error(w, ErrorMessage(err), ErrorStatus(err))
+		return
+	}
+	if !ok {
+		http.Error(w, "このリンクは無効か、有効期限が切れています。もう一度カートを表示してください", 403)
+		return
+	}
+	app.redirectToAmazonCart(w, r, cartKey)
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+const eventKeyPrefix = "buychat:event:"
+
+// eventDedupeKey returns key identifying the event from reply token, timestamp
+// and source
+func eventDedupeKey(event *linebot.Event) string {
+	source := ""
+	if event.Source != nil {
+		source = fmt.Sprintf("%v:%v:%v:%v", event.Source.Type, event.Source.UserID, event.Source.GroupID, event.Source.RoomID)
+	}
+	sum := sha1.Sum([]byte(fmt.Sprintf("%v|%v|%v", event.ReplyToken, event.Timestamp.UnixNano(), source)))
+	return eventKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// claimEvent records the event as processed and returns false if it was
+// already claimed
+func (app *App) claimEvent(event *linebot.Event) bool {
+	claimed, err := app.Store.SetNX(eventDedupeKey(event), time.Now().Format(time.RFC3339), app.Queue.DedupeTTL)
+	if err != nil {
+		app.Log.Printf("Failed to record event %v %v", err, event)
+		return true
+	}
+	return claimed
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+const replyTokenErrorMessage = "Invalid reply token"
+
+// Delivery delivers messages for an event, replying with the reply token while
+// it is usable and pushing to the event source afterwards
+type Delivery struct {
+	ReplyToken string
+	To         string
+	UserID     string
+	ReceivedAt time.Time
+	mu         sync.Mutex
+	replied    bool
+	answered   bool
+	changed    bool
+}
+
+// MarkChanged records that handling the event is about to change state, so
+// that the event is never handled again
+func (delivery *Delivery) MarkChanged() {
+	delivery.mu.Lock()
+	defer delivery.mu.Unlock()
+	delivery.changed = true
+}
+
+// Retryable returns true while handling the event neither changed state nor
+// sent messages other than acknowledgement
+func (delivery *Delivery) Retryable() bool {
+	delivery.mu.Lock()
+	defer delivery.mu.Unlock()
+	return !delivery.changed && !delivery.answered
+}
+
+// NewDelivery returns new delivery for the event
+func NewDelivery(event *linebot.Event) *Delivery {
+	delivery := &Delivery{
+		ReplyToken: event.ReplyToken,
+		ReceivedAt: event.Timestamp,
+	}
+	if delivery.ReceivedAt.IsZero() {
+		delivery.ReceivedAt = time.Now()
+	}
+	if event.Source != nil {
+		delivery.UserID = event.Source.UserID
+		switch event.Source.Type {
+		case linebot.EventSourceTypeRoom:
+			delivery.To = event.Source.RoomID
+		case linebot.EventSourceTypeGroup:
+			delivery.To = event.Source.GroupID
+		case linebot.EventSourceTypeUser:
+			delivery.To = event.Source.UserID
+		}
+	}
+	return delivery
+}
+
+// DeliveryPolicy configures when to push messages instead of replying
+type DeliveryPolicy struct {
+	// ReplyTimeout is how long reply tokens are used before pushing instead
+	ReplyTimeout time.Duration
+	// AcknowledgeThreshold is the expected wait to send acknowledgement for
+	AcknowledgeThreshold time.Duration
+}
+
+// SetupDelivery sets up delivery policy
+func (app *App) SetupDelivery() error {
+	var err error
+	policy := &DeliveryPolicy{}
+	if policy.ReplyTimeout, err = envDuration("REPLY_TIMEOUT", 25*time.Second); err != nil {
+		return err
+	}
+	if policy.AcknowledgeThreshold, err = envDuration("ACKNOWLEDGE_THRESHOLD", 3*time.Second); err != nil {
+		return err
+	}
+	app.DeliveryPolicy = policy
+	return nil
+}
+
+// Reply sends messages with the reply token, or pushes them to the source when
+// the token is already used, expired or older than ReplyTimeout
+func (app *App) Reply(delivery *Delivery, messages ...linebot.Message) error {
+	return app.deliver(delivery, true, messages...)
+}
+
+func (app *App) deliver(delivery *Delivery, answer bool, messages ...linebot.Message) error {
+	delivery.mu.Lock()
+	defer delivery.mu.Unlock()
+	delivery.answered = delivery.answered || answer
+	if !delivery.replied && time.Since(delivery.ReceivedAt) < app.DeliveryPolicy.ReplyTimeout {
+		delivery.replied = true
+		_, err := app.Line.ReplyMessage(delivery.ReplyToken, messages...).Do()
+		if err == nil || !isReplyTokenError(err) || delivery.To == "" {
+			return err
+		}
+		app.Log.Printf("Reply token is not available, pushing to %v: %v", delivery.To, err)
+	}
+	_, err := app.Line.PushMessage(delivery.To, messages...).Do()
+	return err
+}
+
+// Acknowledge replies text immediately if the following work is expected to
+// take longer than AcknowledgeThreshold, so that results are pushed later
+func (app *App) Acknowledge(delivery *Delivery, text string, expected time.Duration) error {
+	if expected < app.DeliveryPolicy.AcknowledgeThreshold || delivery.To == "" {
+		return nil
+	}
+	delivery.mu.Lock()
+	replied := delivery.replied
+	delivery.mu.Unlock()
+	if replied {
+		return nil
+	}
+	return app.deliver(delivery, false, linebot.NewTextMessage(text))
+}
+
+// isReplyTokenError returns true when LINE rejected the reply token as used
+// or expired, rather than the messages
+func isReplyTokenError(err error) bool {
+	e, ok := err.(*linebot.APIError)
+	return ok && e.Code == http.StatusBadRequest && e.Response != nil &&
+		strings.EqualFold(e.Response.Message, replyTokenErrorMessage)
+}
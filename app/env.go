@@ -0,0 +1,70 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+func envInt(name string, defaultValue int) (int, error) {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %v: %v", name, str)
+	}
+	return value, nil
+}
+
+func envTime(name string) (time.Time, error) {
+	str := os.Getenv(name)
+	if str == "" {
+		return time.Time{}, nil
+	}
+	value, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid %v: %v", name, str)
+	}
+	return value, nil
+}
+
+func envDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %v: %v", name, str)
+	}
+	return value, nil
+}
+
+// envDeadline returns time in the environment variable name, or the end of
+// window in windowName from the first start without it, which is recorded at
+// key so that restarts do not extend the window
+func (app *App) envDeadline(name string, windowName string, window time.Duration, key string) (time.Time, error) {
+	deadline, err := envTime(name)
+	if err != nil || !deadline.IsZero() {
+		return deadline, err
+	}
+	if window, err = envDuration(windowName, window); err != nil {
+		return time.Time{}, err
+	}
+	until := time.Now().Add(window)
+	err = app.Store.Update(key, 0, func(value string, ok bool) (string, error) {
+		if t, err := time.Parse(time.RFC3339, value); ok && err == nil {
+			deadline = t
+			return value, nil
+		}
+		deadline = until
+		return until.Format(time.RFC3339), nil
+	})
+	if err != nil {
+		return time.Time{}, storageError(err)
+	}
+	return deadline, nil
+}
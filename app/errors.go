@@ -0,0 +1,155 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ngs/go-amazon-product-advertising-api/amazon"
+)
+
+// ErrorKind classifies errors for user facing responses
+type ErrorKind int
+
+const (
+	// ErrorKindUnknown unclassified error
+	ErrorKindUnknown ErrorKind = iota
+	// ErrorKindThrottled Amazon throttled requests or rate limit exceeded
+	ErrorKindThrottled
+	// ErrorKindNoResults no item matched
+	ErrorKindNoResults
+	// ErrorKindInvalidParameter request to Amazon was invalid
+	ErrorKindInvalidParameter
+	// ErrorKindUpstreamUnavailable Amazon could not be reached or failed
+	ErrorKindUpstreamUnavailable
+	// ErrorKindStorage cart storage failed
+	ErrorKindStorage
+)
+
+// Error is an error with its kind
+type Error struct {
+	Kind ErrorKind
+	// Subject describes what was searched, used for no results message
+	Subject string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v %v", e.Kind, e.Subject)
+	}
+	return e.Err.Error()
+}
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindThrottled:
+		return "Throttled"
+	case ErrorKindNoResults:
+		return "NoResults"
+	case ErrorKindInvalidParameter:
+		return "InvalidParameter"
+	case ErrorKindUpstreamUnavailable:
+		return "UpstreamUnavailable"
+	case ErrorKindStorage:
+		return "Storage"
+	}
+	return "Unknown"
+}
+
+func errorKindOf(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return ErrorKindUnknown
+}
+
+func noResultsError(subject string) error {
+	return &Error{Kind: ErrorKindNoResults, Subject: subject}
+}
+
+func storageError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: ErrorKindStorage, Err: err}
+}
+
+func amazonError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	kind := ErrorKindUpstreamUnavailable
+	switch {
+	case isThrottleError(err) || isBusyError(err):
+		kind = ErrorKindThrottled
+	default:
+		switch amazonErrorCode(err) {
+		case amazon.NoExactMatches, amazon.NoSimilarities:
+			kind = ErrorKindNoResults
+		case amazon.InvalidParameterValue,
+			amazon.InvalidParameterCombination,
+			amazon.InvalidEnumeratedParameter,
+			amazon.MissingParameters,
+			amazon.MissingParameterCombination,
+			amazon.MissingParameterValueCombination,
+			amazon.ParameterOutOfRange,
+			amazon.ParameterRepeatedInRequest,
+			amazon.RestrictedParameterValueCombination,
+			amazon.ExceededMaximumParameterValues,
+			amazon.InsufficientParameterValues,
+			amazon.ItemNotAccessible,
+			amazon.ItemNotEligibleForCart,
+			amazon.InvalidQuantity:
+			kind = ErrorKindInvalidParameter
+		}
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// ErrorMessage returns message to reply to users for the error
+func ErrorMessage(err error) string {
+	if e, ok := err.(*Error); ok {
+		switch e.Kind {
+		case ErrorKindThrottled:
+			return "申し訳ありません、すこし待ってから、もう一度お試しください"
+		case ErrorKindNoResults:
+			if e.Subject != "" {
+				return "ごめんなさい、" + e.Subject + " に該当する商品はみつかりませんでした"
+			}
+			return "ごめんなさい、該当する商品はみつかりませんでした"
+		case ErrorKindInvalidParameter:
+			return "ごめんなさい、この条件では検索できませんでした"
+		case ErrorKindUpstreamUnavailable:
+			return "ごめんなさい、Amazon に接続できませんでした。しばらくしてから、もう一度お試しください"
+		case ErrorKindStorage:
+			return "ごめんなさい、カートの読み書きに失敗しました。しばらくしてから、もう一度お試しください"
+		}
+	}
+	return "ごめんなさい、検索中にエラーが発生してしまいました"
+}
+
+// ErrorStatus returns HTTP status code for the error
+func ErrorStatus(err error) int {
+	switch errorKindOf(err) {
+	case ErrorKindThrottled:
+		return http.StatusServiceUnavailable
+	case ErrorKindNoResults:
+		return http.StatusNotFound
+	case ErrorKindInvalidParameter:
+		return http.StatusBadRequest
+	case ErrorKindUpstreamUnavailable:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func shouldReportError(err error) bool {
+	switch errorKindOf(err) {
+	case ErrorKindThrottled, ErrorKindNoResults, ErrorKindInvalidParameter:
+		return false
+	}
+	return true
+}
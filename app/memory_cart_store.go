@@ -0,0 +1,187 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryCartStore stores carts in process memory
+type MemoryCartStore struct {
+	mu      sync.Mutex
+	carts   map[string][]CartItem
+	index   map[string]time.Time
+	expired map[string]time.Time
+}
+
+// NewMemoryCartStore returns new in-memory cart store
+func NewMemoryCartStore() *MemoryCartStore {
+	return &MemoryCartStore{
+		carts:   map[string][]CartItem{},
+		index:   map[string]time.Time{},
+		expired: map[string]time.Time{},
+	}
+}
+
+// evict drops items of the cart once it expired, leaving the index entry for
+// Touch and Expire
+func (s *MemoryCartStore) evict(cartKey string) {
+	if expiresAt, ok := s.index[cartKey]; ok && !time.Now().Before(expiresAt) {
+		delete(s.carts, cartKey)
+	}
+}
+
+func (s *MemoryCartStore) indexOf(cartKey string, ASIN string) int {
+	for i, item := range s.carts[cartKey] {
+		if item.ASIN == ASIN {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *MemoryCartStore) removeAt(cartKey string, i int) {
+	items := s.carts[cartKey]
+	s.carts[cartKey] = append(items[:i:i], items[i+1:]...)
+	if len(s.carts[cartKey]) == 0 {
+		delete(s.carts, cartKey)
+	}
+}
+
+// Size returns cart size
+func (s *MemoryCartStore) Size(cartKey string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(cartKey)
+	return len(s.carts[cartKey]), nil
+}
+
+// Clear clears items
+func (s *MemoryCartStore) Clear(cartKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.carts, cartKey)
+	return nil
+}
+
+// Add adds items to cart
+func (s *MemoryCartStore) Add(cartKey string, ASIN string, addedBy string, capacity int) (CartAddResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(cartKey)
+	if s.indexOf(cartKey, ASIN) >= 0 {
+		return CartAddResultDuplicate, nil
+	}
+	if len(s.carts[cartKey]) >= capacity {
+		return CartAddResultFull, nil
+	}
+	s.carts[cartKey] = append(s.carts[cartKey], CartItem{ASIN: ASIN, Quantity: 1, AddedBy: addedBy})
+	return CartAddResultAdded, nil
+}
+
+// Remove removes items from cart
+func (s *MemoryCartStore) Remove(cartKey string, ASIN string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(cartKey)
+	if i := s.indexOf(cartKey, ASIN); i >= 0 {
+		s.removeAt(cartKey, i)
+	}
+	return nil
+}
+
+// ChangeQuantity changes quantity of the item
+func (s *MemoryCartStore) ChangeQuantity(cartKey string, ASIN string, delta int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(cartKey)
+	i := s.indexOf(cartKey, ASIN)
+	if i < 0 {
+		return 0, nil
+	}
+	quantity := s.carts[cartKey][i].Quantity + delta
+	if quantity <= 0 {
+		s.removeAt(cartKey, i)
+		return 0, nil
+	}
+	s.carts[cartKey][i].Quantity = quantity
+	return quantity, nil
+}
+
+// Items returns items in cart
+func (s *MemoryCartStore) Items(cartKey string) ([]CartItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(cartKey)
+	return append([]CartItem{}, s.carts[cartKey]...), nil
+}
+
+// Touch sets expiry of the cart
+func (s *MemoryCartStore) Touch(cartKey string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := false
+	if previous, ok := s.index[cartKey]; ok && !time.Now().Before(previous) {
+		s.expired[cartKey] = previous
+		expired = true
+	}
+	s.evict(cartKey)
+	if len(s.carts[cartKey]) == 0 {
+		delete(s.index, cartKey)
+		return expired, nil
+	}
+	s.index[cartKey] = expiresAt
+	return expired, nil
+}
+
+// Expiring returns carts expiring before t
+func (s *MemoryCartStore) Expiring(t time.Time) ([]CartExpiry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiries := []CartExpiry{}
+	for cartKey, expiresAt := range s.index {
+		if !expiresAt.After(t) {
+			expiries = append(expiries, CartExpiry{CartKey: cartKey, ExpiresAt: expiresAt})
+		}
+	}
+	return expiries, nil
+}
+
+// Expire moves the cart to the expired index
+func (s *MemoryCartStore) Expire(expiry CartExpiry) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expiresAt, ok := s.index[expiry.CartKey]; !ok || !expiresAt.Equal(expiry.ExpiresAt) {
+		return false, nil
+	}
+	s.evict(expiry.CartKey)
+	delete(s.index, expiry.CartKey)
+	s.expired[expiry.CartKey] = expiry.ExpiresAt
+	return true, nil
+}
+
+// Count returns numbers of active and expired carts
+func (s *MemoryCartStore) Count(t time.Time) (CartCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := CartCount{Expired: len(s.expired)}
+	for _, expiresAt := range s.index {
+		if expiresAt.After(t) {
+			count.Active++
+		} else {
+			count.Expired++
+		}
+	}
+	return count, nil
+}
+
+// PruneExpired removes carts expired before t from the expired index
+func (s *MemoryCartStore) PruneExpired(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for cartKey, expiresAt := range s.expired {
+		if expiresAt.Before(t) {
+			delete(s.expired, cartKey)
+		}
+	}
+	return nil
+}
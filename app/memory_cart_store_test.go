@@ -0,0 +1,136 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryCartStoreAdd(t *testing.T) {
+	type add struct {
+		ASIN     string
+		capacity int
+		expected CartAddResult
+	}
+	cases := []struct {
+		name     string
+		adds     []add
+		expected []string
+	}{
+		{
+			name: "within capacity",
+			adds: []add{
+				{"B000000001", 2, CartAddResultAdded},
+				{"B000000002", 2, CartAddResultAdded},
+			},
+			expected: []string{"B000000001", "B000000002"},
+		},
+		{
+			name: "duplicate",
+			adds: []add{
+				{"B000000001", 2, CartAddResultAdded},
+				{"B000000001", 2, CartAddResultDuplicate},
+			},
+			expected: []string{"B000000001"},
+		},
+		{
+			name: "full",
+			adds: []add{
+				{"B000000001", 1, CartAddResultAdded},
+				{"B000000002", 1, CartAddResultFull},
+			},
+			expected: []string{"B000000001"},
+		},
+		{
+			name: "duplicate in full cart",
+			adds: []add{
+				{"B000000001", 1, CartAddResultAdded},
+				{"B000000001", 1, CartAddResultDuplicate},
+			},
+			expected: []string{"B000000001"},
+		},
+		{
+			name: "zero capacity",
+			adds: []add{
+				{"B000000001", 0, CartAddResultFull},
+			},
+			expected: []string{},
+		},
+	}
+	for _, c := range cases {
+		store := NewMemoryCartStore()
+		for i, a := range c.adds {
+			result, err := store.Add("buychat:line:user:U1", a.ASIN, "U1", a.capacity)
+			if err != nil {
+				t.Fatalf("%v: add %d got error %v", c.name, i, err)
+			}
+			if result != a.expected {
+				t.Errorf("%v: add %d expected %v but got %v", c.name, i, a.expected, result)
+			}
+		}
+		items, _ := store.Items("buychat:line:user:U1")
+		if len(items) != len(c.expected) {
+			t.Errorf("%v: expected %v but got %v", c.name, c.expected, items)
+			continue
+		}
+		for i, item := range items {
+			if item.ASIN != c.expected[i] || item.Quantity != 1 || item.AddedBy != "U1" {
+				t.Errorf("%v: expected %v at %d but got %v", c.name, c.expected[i], i, item)
+			}
+		}
+	}
+}
+
+func TestMemoryCartStoreChangeQuantity(t *testing.T) {
+	cases := []struct {
+		name     string
+		deltas   []int
+		expected int
+		size     int
+	}{
+		{"increase", []int{1, 2}, 4, 1},
+		{"decrease", []int{2, -1}, 2, 1},
+		{"decrease to zero removes item", []int{-1}, 0, 0},
+		{"decrease below zero removes item", []int{1, -5}, 0, 0},
+	}
+	for _, c := range cases {
+		store := NewMemoryCartStore()
+		store.Add("buychat:line:user:U1", "B000000001", "U1", 5)
+		quantity := 0
+		for _, delta := range c.deltas {
+			var err error
+			if quantity, err = store.ChangeQuantity("buychat:line:user:U1", "B000000001", delta); err != nil {
+				t.Fatalf("%v: got error %v", c.name, err)
+			}
+		}
+		if quantity != c.expected {
+			t.Errorf("%v: expected quantity %d but got %d", c.name, c.expected, quantity)
+		}
+		if size, _ := store.Size("buychat:line:user:U1"); size != c.size {
+			t.Errorf("%v: expected size %d but got %d", c.name, c.size, size)
+		}
+	}
+}
+
+func TestMemoryCartStoreExpiry(t *testing.T) {
+	store := NewMemoryCartStore()
+	cartKey := "buychat:line:user:U1"
+	now := time.Now()
+	store.Add(cartKey, "B000000001", "U1", 5)
+	if expired, err := store.Touch(cartKey, now.Add(-time.Second)); err != nil || expired {
+		t.Fatalf("expected first touch not to expire but got %v %v", expired, err)
+	}
+	if size, _ := store.Size(cartKey); size != 0 {
+		t.Errorf("expected expired cart to be empty but got %d items", size)
+	}
+	expiries, _ := store.Expiring(now)
+	if len(expiries) != 1 || expiries[0].CartKey != cartKey {
+		t.Fatalf("expected %v to be expiring but got %v", cartKey, expiries)
+	}
+	if moved, err := store.Expire(expiries[0]); err != nil || !moved {
+		t.Errorf("expected cart to be expired but got %v %v", moved, err)
+	}
+	count, _ := store.Count(now)
+	if count.Active != 0 || count.Expired != 1 {
+		t.Errorf("expected 0 active and 1 expired carts but got %v", count)
+	}
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryValue struct {
+	value     string
+	expiresAt time.Time
+}
+
+// MemoryStore stores state in process memory
+type MemoryStore struct {
+	mu     sync.Mutex
+	lists  map[string][]string
+	values map[string]memoryValue
+}
+
+// NewMemoryStore returns new in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		lists:  map[string][]string{},
+		values: map[string]memoryValue{},
+	}
+}
+
+// PushList prepends value to list
+func (s *MemoryStore) PushList(key string, value string, max int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := append([]string{value}, s.lists[key]...)
+	if len(list) > max {
+		list = list[:max]
+	}
+	s.lists[key] = list
+	return nil
+}
+
+// List returns values in list
+func (s *MemoryStore) List(key string, n int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.lists[key]
+	if len(list) > n {
+		list = list[:n]
+	}
+	return append([]string{}, list...), nil
+}
+
+func (s *MemoryStore) get(key string) (string, bool) {
+	v, ok := s.values[key]
+	if !ok {
+		return "", false
+	}
+	if !v.expiresAt.IsZero() && !time.Now().Before(v.expiresAt) {
+		delete(s.values, key)
+		return "", false
+	}
+	return v.value, true
+}
+
+func (s *MemoryStore) set(key string, value string, ttl time.Duration) {
+	v := memoryValue{value: value}
+	if ttl > 0 {
+		v.expiresAt = time.Now().Add(ttl)
+	}
+	s.values[key] = v
+}
+
+// SetNX sets value if key does not exist
+func (s *MemoryStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.get(key); ok {
+		return false, nil
+	}
+	s.set(key, value, ttl)
+	return true, nil
+}
+
+// Set sets value
+func (s *MemoryStore) Set(key string, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, value, ttl)
+	return nil
+}
+
+// Get returns value
+func (s *MemoryStore) Get(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.get(key)
+	return value, ok, nil
+}
+
+// Update replaces value with the one fn returns
+func (s *MemoryStore) Update(key string, ttl time.Duration, fn func(value string, ok bool) (string, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.get(key)
+	value, err := fn(current, ok)
+	if err != nil {
+		return err
+	}
+	s.set(key, value, ttl)
+	return nil
+}
+
+// Del deletes key
+func (s *MemoryStore) Del(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	delete(s.lists, key)
+	return nil
+}
@@ -0,0 +1,381 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const cartListKeyPrefix = "buychat:cart-list:"
+
+// defaultCartID is ID of the cart every source has, stored under the cart key
+// of the source
+const defaultCartID = "main"
+
+const defaultCartName = "メイン"
+
+// namedCartsMax is the maximum number of carts per source
+const namedCartsMax = 10
+
+// cartNameMax is the maximum length of cart names in runes
+const cartNameMax = 20
+
+var (
+	cartCommandRE = regexp.MustCompile(`(?i)^(カートを作成|カートを切り替え|カートを削除|カート名を変更|new cart|switch cart|delete cart|rename cart)\s+(.+)$`)
+	cartListRE    = regexp.MustCompile(`(?i)^(カート一覧|list carts)$`)
+	cartRenameRE  = regexp.MustCompile(`^(.+?)\s*(?:→|->)\s*(.+)$`)
+)
+
+var errNamedCartNotFound = errors.New("Named cart not found")
+
+// NamedCart is a cart of a source with name
+type NamedCart struct {
+	ID   string
+	Name string
+}
+
+// CartList is per-source state of named carts
+type CartList struct {
+	Active string
+	Carts  []NamedCart
+}
+
+func newCartList() *CartList {
+	return &CartList{
+		Active: defaultCartID,
+		Carts:  []NamedCart{{ID: defaultCartID, Name: defaultCartName}},
+	}
+}
+
+// find returns index of the cart with the ID, or -1
+func (list *CartList) find(ID string) int {
+	for i, cart := range list.Carts {
+		if cart.ID == ID {
+			return i
+		}
+	}
+	return -1
+}
+
+// findByName returns index of the cart with the name, or -1
+func (list *CartList) findByName(name string) int {
+	for i, cart := range list.Carts {
+		if strings.EqualFold(cart.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Named returns true when the source uses more than the default cart
+func (list *CartList) Named() bool {
+	return len(list.Carts) > 1 || list.Carts[0].Name != defaultCartName
+}
+
+// cartSourceKey returns cart key of the default cart of the source of the
+// cart key
+func cartSourceKey(cartKey string) string {
+	parts := strings.SplitN(cartKey, ":", 5)
+	if len(parts) < 5 {
+		return cartKey
+	}
+	return strings.Join(parts[0:4], ":")
+}
+
+// cartID returns ID of the cart in the source
+func cartID(cartKey string) string {
+	parts := strings.SplitN(cartKey, ":", 5)
+	if len(parts) < 5 {
+		return defaultCartID
+	}
+	return parts[4]
+}
+
+// namedCartKey returns cart key of the cart with the ID in the source
+func namedCartKey(sourceKey string, ID string) string {
+	if ID == defaultCartID {
+		return sourceKey
+	}
+	return sourceKey + ":" + ID
+}
+
+func (app *App) parseCartList(sourceKey string, str string, ok bool) *CartList {
+	if !ok {
+		return newCartList()
+	}
+	var list CartList
+	if err := json.Unmarshal([]byte(str), &list); err != nil || len(list.Carts) == 0 {
+		app.Log.Printf("Reset broken cart list %v %v", err, sourceKey)
+		return newCartList()
+	}
+	return &list
+}
+
+func (app *App) loadCartList(sourceKey string) (*CartList, error) {
+	str, ok, err := app.Store.Get(cartListKeyPrefix + sourceKey)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	return app.parseCartList(sourceKey, str, ok), nil
+}
+
+// updateCartList atomically applies fn to the cart list of the source and
+// saves it, unless fn returns error
+func (app *App) updateCartList(sourceKey string, fn func(list *CartList) error) (*CartList, error) {
+	var list *CartList
+	var reason error
+	err := app.Store.Update(cartListKeyPrefix+sourceKey, 0, func(str string, ok bool) (string, error) {
+		list = app.parseCartList(sourceKey, str, ok)
+		if reason = fn(list); reason != nil {
+			return "", reason
+		}
+		data, _ := json.Marshal(list)
+		return string(data), nil
+	})
+	if reason != nil {
+		return nil, reason
+	}
+	if err != nil {
+		return nil, storageError(err)
+	}
+	return list, nil
+}
+
+// ActiveCartKey returns cart key of the active cart of the source
+func (app *App) ActiveCartKey(sourceKey string) (string, error) {
+	list, err := app.loadCartList(sourceKey)
+	if err != nil {
+		return "", err
+	}
+	if list.find(list.Active) < 0 {
+		return sourceKey, nil
+	}
+	return namedCartKey(sourceKey, list.Active), nil
+}
+
+// CartName returns name of the cart, or empty string when the source only
+// has the default cart
+func (app *App) CartName(cartKey string) string {
+	list, err := app.loadCartList(cartSourceKey(cartKey))
+	if err != nil {
+		app.Log.Printf("Failed to load cart list %v %v", err, cartKey)
+		return ""
+	}
+	if i := list.find(cartID(cartKey)); i >= 0 && list.Named() {
+		return list.Carts[i].Name
+	}
+	return ""
+}
+
+// cartLabel returns "カート" decorated with the cart name
+func (app *App) cartLabel(cartKey string) string {
+	if name := app.CartName(cartKey); name != "" {
+		return "「" + name + "」カート"
+	}
+	return "カート"
+}
+
+// cartCommandError is a reason to reject a cart command, replied as is
+type cartCommandError string
+
+func (err cartCommandError) Error() string {
+	return string(err)
+}
+
+// validateCartName returns error when the name cannot be used for a cart
+func validateCartName(name string) error {
+	if strings.ContainsAny(name, "\r\n") || len([]rune(name)) > cartNameMax {
+		return cartCommandError("カートの名前は改行なしの" + strconv.Itoa(cartNameMax) + "文字以内にしてください")
+	}
+	if strings.Contains(name, "→") || strings.Contains(name, "->") {
+		return cartCommandError("カートの名前に「→」は使えません")
+	}
+	return nil
+}
+
+// parseCartRename returns current and new names from arguments of rename
+// command, either "current → new" or two names separated by space
+func parseCartRename(args string) (string, string, bool) {
+	if m := cartRenameRE.FindStringSubmatch(args); m != nil {
+		return strings.TrimSpace(m[1]), strings.TrimSpace(m[2]), true
+	}
+	if fields := strings.Fields(args); len(fields) == 2 {
+		return fields[0], fields[1], true
+	}
+	return "", "", false
+}
+
+// HandleCartCommand handles text commands for named carts and returns false
+// when the text is not a command
+func (app *App) HandleCartCommand(delivery *Delivery, text string, cartKey string) (bool, error) {
+	text = strings.TrimSpace(text)
+	if cartListRE.MatchString(text) {
+		return true, app.HandleListCarts(delivery, cartKey)
+	}
+	m := cartCommandRE.FindStringSubmatch(text)
+	if m == nil {
+		return false, nil
+	}
+	args := strings.TrimSpace(m[2])
+	sourceKey := cartSourceKey(cartKey)
+	var err error
+	switch strings.ToLower(m[1]) {
+	case "カートを作成", "new cart":
+		err = app.createNamedCart(delivery, sourceKey, args)
+	case "カートを切り替え", "switch cart":
+		err = app.switchNamedCart(delivery, sourceKey, args)
+	case "カートを削除", "delete cart":
+		err = app.deleteNamedCart(delivery, sourceKey, args)
+	case "カート名を変更", "rename cart":
+		err = app.renameNamedCart(delivery, sourceKey, args)
+	default:
+		return false, nil
+	}
+	if reason, ok := err.(cartCommandError); ok {
+		return true, app.ReplyText(delivery, string(reason))
+	}
+	return true, err
+}
+
+func (app *App) createNamedCart(delivery *Delivery, sourceKey string, name string) error {
+	if err := validateCartName(name); err != nil {
+		return err
+	}
+	ID, err := newRandomToken(6)
+	if err != nil {
+		return err
+	}
+	delivery.MarkChanged()
+	if _, err := app.updateCartList(sourceKey, func(list *CartList) error {
+		if list.findByName(name) >= 0 {
+			return cartCommandError("「" + name + "」カートはすでにあります")
+		}
+		if len(list.Carts) >= namedCartsMax {
+			return cartCommandError("カートは" + strconv.Itoa(namedCartsMax) + "個までしか作れません")
+		}
+		list.Carts = append(list.Carts, NamedCart{ID: ID, Name: name})
+		list.Active = ID
+		return nil
+	}); err != nil {
+		return err
+	}
+	return app.ReplyText(delivery, "「"+name+"」カートを作成して、切り替えました")
+}
+
+func (app *App) switchNamedCart(delivery *Delivery, sourceKey string, name string) error {
+	delivery.MarkChanged()
+	var cart NamedCart
+	_, err := app.updateCartList(sourceKey, func(list *CartList) error {
+		i := list.findByName(name)
+		if i < 0 {
+			return errNamedCartNotFound
+		}
+		cart = list.Carts[i]
+		list.Active = cart.ID
+		return nil
+	})
+	if err == errNamedCartNotFound {
+		return app.HandleListCarts(delivery, sourceKey)
+	}
+	if err != nil {
+		return err
+	}
+	return app.ReplyText(delivery, "「"+cart.Name+"」カートに切り替えました")
+}
+
+// deleteNamedCart clears the cart before removing it from the list, so that
+// items are never left in a cart which is not listed
+func (app *App) deleteNamedCart(delivery *Delivery, sourceKey string, name string) error {
+	list, err := app.loadCartList(sourceKey)
+	if err != nil {
+		return err
+	}
+	i := list.findByName(name)
+	if i < 0 {
+		return cartCommandError("「" + name + "」カートはありません")
+	}
+	cart := list.Carts[i]
+	if cart.ID == defaultCartID {
+		return cartCommandError("「" + cart.Name + "」カートは削除できません")
+	}
+	cartKey := namedCartKey(sourceKey, cart.ID)
+	if addedBy, err := app.removalDeniedBy(cartKey, "", delivery.UserID); err != nil {
+		return err
+	} else if addedBy != "" {
+		return app.replyRemovalDenied(delivery, addedBy)
+	}
+	delivery.MarkChanged()
+	if err := app.ClearCart(cartKey); err != nil {
+		return err
+	}
+	app.dropAmazonCart(cartKey)
+	if err := app.Store.Del(cartLogKey(cartKey)); err != nil {
+		app.Log.Printf("Failed to drop cart log %v %v", err, cartKey)
+	}
+	list, err = app.updateCartList(sourceKey, func(list *CartList) error {
+		if i := list.find(cart.ID); i >= 0 {
+			list.Carts = append(list.Carts[:i:i], list.Carts[i+1:]...)
+		}
+		if list.find(list.Active) < 0 {
+			list.Active = defaultCartID
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return app.ReplyText(delivery, "「"+cart.Name+"」カートを削除しました\n"+
+		"いまのカート: 「"+list.Carts[list.find(list.Active)].Name+"」")
+}
+
+func (app *App) renameNamedCart(delivery *Delivery, sourceKey string, args string) error {
+	old, name, ok := parseCartRename(args)
+	if !ok {
+		return cartCommandError("「カート名を変更 いまの名前 → 新しい名前」の形で送ってください")
+	}
+	if err := validateCartName(name); err != nil {
+		return err
+	}
+	delivery.MarkChanged()
+	var cart NamedCart
+	if _, err := app.updateCartList(sourceKey, func(list *CartList) error {
+		i := list.findByName(old)
+		if i < 0 {
+			return cartCommandError("「" + old + "」カートはありません")
+		}
+		if j := list.findByName(name); j >= 0 && j != i {
+			return cartCommandError("「" + name + "」カートはすでにあります")
+		}
+		cart = list.Carts[i]
+		list.Carts[i].Name = name
+		return nil
+	}); err != nil {
+		return err
+	}
+	return app.ReplyText(delivery, "「"+cart.Name+"」カートの名前を「"+name+"」に変更しました")
+}
+
+// HandleListCarts replies carts of the source with their sizes
+func (app *App) HandleListCarts(delivery *Delivery, cartKey string) error {
+	sourceKey := cartSourceKey(cartKey)
+	list, err := app.loadCartList(sourceKey)
+	if err != nil {
+		return err
+	}
+	text := "カート一覧"
+	for _, cart := range list.Carts {
+		size, err := app.CartSize(namedCartKey(sourceKey, cart.ID))
+		if err != nil {
+			return err
+		}
+		mark := "　"
+		if cart.ID == list.Active {
+			mark = "▶"
+		}
+		text += "\n" + mark + cart.Name + " (" + strconv.Itoa(size) + "点)"
+	}
+	text += "\n\n「カートを作成 名前」「カートを切り替え 名前」「カート名を変更 いまの名前 → 新しい名前」「カートを削除 名前」で操作できます"
+	return app.ReplyText(delivery, text)
+}
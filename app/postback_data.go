@@ -1,5 +1,32 @@
 package app
 
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+const postbackKeyPrefix = "buychat:postback:"
+
+const postbackUnsignedUntilKey = "buychat:postback-unsigned-until"
+
+// postbackVersion is the current version of postback data format
+const postbackVersion = 1
+
+var (
+	// errPostbackExpired is returned when payload for the postback token is gone
+	errPostbackExpired = errors.New("Postback token expired")
+	// errPostbackInvalid is returned for tampered or unknown version of postback data
+	errPostbackInvalid = errors.New("Postback data is invalid")
+)
+
 // PostbackAction PostbackAction
 type PostbackAction string
 
@@ -12,13 +39,188 @@ const (
 	PostbackActionRemoveCart PostbackAction = "remove-cart"
 	// PostbackActionShowCart show-cart
 	PostbackActionShowCart PostbackAction = "show-cart"
+	// PostbackActionIncreaseQuantity increase-quantity
+	PostbackActionIncreaseQuantity PostbackAction = "increase-quantity"
+	// PostbackActionDecreaseQuantity decrease-quantity
+	PostbackActionDecreaseQuantity PostbackAction = "decrease-quantity"
+	// PostbackActionNextResults next-results
+	PostbackActionNextResults PostbackAction = "next-results"
+	// PostbackActionUndoCart undo-cart
+	PostbackActionUndoCart PostbackAction = "undo-cart"
+	// PostbackActionAddWishlist add-wishlist
+	PostbackActionAddWishlist PostbackAction = "add-wishlist"
+	// PostbackActionShowWishlist show-wishlist
+	PostbackActionShowWishlist PostbackAction = "show-wishlist"
+	// PostbackActionRemoveWishlist remove-wishlist
+	PostbackActionRemoveWishlist PostbackAction = "remove-wishlist"
+	// PostbackActionMoveToCart move-to-cart
+	PostbackActionMoveToCart PostbackAction = "move-to-cart"
+	// PostbackActionMoveToWishlist move-to-wishlist
+	PostbackActionMoveToWishlist PostbackAction = "move-to-wishlist"
+	// PostbackActionCartItemMenu cart-item-menu
+	PostbackActionCartItemMenu PostbackAction = "cart-item-menu"
 )
 
 // PostbackData PostbackData
 type PostbackData struct {
-	Action   PostbackAction
-	ASIN     string
-	ImageURL string
-	Label    string
-	Title    string
+	Action      PostbackAction
+	ASIN        string `json:",omitempty"`
+	ImageURL    string `json:",omitempty"`
+	Label       string `json:",omitempty"`
+	Title       string `json:",omitempty"`
+	Query       string `json:",omitempty"`
+	SearchIndex string `json:",omitempty"`
+	Page        int    `json:",omitempty"`
+	Offset      int    `json:",omitempty"`
+	ChangeID    string `json:",omitempty"`
+	Cart        string `json:",omitempty"`
+	Token       string `json:",omitempty"`
+	Version     int    `json:",omitempty"`
+	Signature   string `json:",omitempty"`
+}
+
+// PostbackCodec encodes and decodes postback data. Payloads are stored under
+// random tokens, and postback data is versioned and signed with Key.
+type PostbackCodec struct {
+	Store Store
+	TTL   time.Duration
+	Key   []byte
+	// UnsignedUntil is when unsigned postback data created before versioning
+	// stops being accepted for legacy actions. Zero rejects it.
+	UnsignedUntil time.Time
+}
+
+// isLegacyPostbackAction returns true for actions of unsigned postback data
+// which are accepted during rollout. Actions which remove items are never
+// accepted unsigned, as they could be forged to empty carts.
+func isLegacyPostbackAction(action PostbackAction) bool {
+	switch action {
+	case PostbackActionAddCart, PostbackActionShowCart, PostbackActionNextResults, PostbackActionIncreaseQuantity:
+		return true
+	}
+	return false
+}
+
+// postbackEncoder encodes postback data and keeps the first error
+type postbackEncoder struct {
+	app *App
+	err error
+}
+
+// Encode returns postback data string. Payload other than Action is stored
+// under a random token so that postback data fits in LINE's limit.
+func (e *postbackEncoder) Encode(data *PostbackData) string {
+	str, err := e.app.Postbacks.Encode(data)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return str
+}
+
+// Action returns postback action with encoded data
+func (e *postbackEncoder) Action(label string, data *PostbackData) linebot.TemplateAction {
+	return linebot.NewPostbackTemplateAction(label, e.Encode(data), "")
+}
+
+// Encode returns signed postback data string for the data
+func (c *PostbackCodec) Encode(data *PostbackData) (string, error) {
+	envelope := &PostbackData{Action: data.Action}
+	if *data != *envelope {
+		payload, _ := json.Marshal(data)
+		token, err := newRandomToken(9)
+		if err == nil {
+			err = c.Store.Set(postbackKeyPrefix+token, string(payload), c.TTL)
+		}
+		if err != nil {
+			return "", storageError(err)
+		}
+		envelope.Token = token
+	}
+	envelope.Version = postbackVersion
+	envelope.Signature = c.sign(envelope)
+	bytes, _ := json.Marshal(envelope)
+	return string(bytes), nil
+}
+
+// Decode verifies postback data string and resolves its token
+func (c *PostbackCodec) Decode(dataString string) (PostbackData, error) {
+	var data PostbackData
+	if err := json.Unmarshal([]byte(dataString), &data); err != nil {
+		return data, errPostbackInvalid
+	}
+	switch data.Version {
+	case 0:
+		if !time.Now().Before(c.UnsignedUntil) || !isLegacyPostbackAction(data.Action) {
+			return data, errPostbackInvalid
+		}
+	case postbackVersion:
+		if !hmac.Equal([]byte(data.Signature), []byte(c.sign(&data))) {
+			return data, errPostbackInvalid
+		}
+	default:
+		return data, errPostbackInvalid
+	}
+	if data.Token == "" {
+		return data, nil
+	}
+	payload, ok, err := c.Store.Get(postbackKeyPrefix + data.Token)
+	if err != nil {
+		return data, storageError(err)
+	}
+	if !ok {
+		return data, errPostbackExpired
+	}
+	var resolved PostbackData
+	if err := json.Unmarshal([]byte(payload), &resolved); err != nil {
+		return data, err
+	}
+	if resolved.Action != data.Action {
+		return data, errPostbackInvalid
+	}
+	return resolved, nil
+}
+
+func (c *PostbackCodec) sign(data *PostbackData) string {
+	unsigned := *data
+	unsigned.Signature = ""
+	bytes, _ := json.Marshal(&unsigned)
+	mac := hmac.New(sha256.New, c.Key)
+	mac.Write(bytes)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// newRandomToken returns URL safe random token of size bytes
+func newRandomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// deriveKey returns key for the purpose derived from the channel secret
+func deriveKey(secret string, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// SetupPostback sets up postback codec
+func (app *App) SetupPostback() error {
+	ttl, err := envDuration("POSTBACK_TTL", 7*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	unsignedUntil, err := app.envDeadline("POSTBACK_UNSIGNED_UNTIL", "POSTBACK_UNSIGNED_WINDOW", 30*24*time.Hour, postbackUnsignedUntilKey)
+	if err != nil {
+		return err
+	}
+	app.Log.Printf("Unsigned postback data is accepted until %v", unsignedUntil.Format(time.RFC3339))
+	app.Postbacks = &PostbackCodec{
+		Store:         app.Store,
+		TTL:           ttl,
+		Key:           deriveKey(os.Getenv("LINE_CHANNEL_SECRET"), "buychat:postback"),
+		UnsignedUntil: unsignedUntil,
+	}
+	return nil
 }
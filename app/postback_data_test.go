@@ -0,0 +1,148 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func newTestPostbackCodec(unsignedUntil time.Time) *PostbackCodec {
+	return &PostbackCodec{
+		Store:         NewMemoryStore(),
+		TTL:           time.Hour,
+		Key:           deriveKey("secret", "buychat:postback"),
+		UnsignedUntil: unsignedUntil,
+	}
+}
+
+func TestPostbackCodecSigned(t *testing.T) {
+	cases := []*PostbackData{
+		{Action: PostbackActionShowCart},
+		{Action: PostbackActionAddCart, ASIN: "B000000001", Title: "商品", Label: "¥1,000"},
+		{Action: PostbackActionNextResults, Query: "golang", SearchIndex: "Books", Page: 2, Offset: 3},
+	}
+	codec := newTestPostbackCodec(time.Time{})
+	for _, data := range cases {
+		str, err := codec.Encode(data)
+		if err != nil {
+			t.Fatalf("%v: got error %v", data.Action, err)
+		}
+		decoded, err := codec.Decode(str)
+		if err != nil {
+			t.Errorf("%v: got error %v", data.Action, err)
+			continue
+		}
+		if data.ASIN != "" || data.Query != "" {
+			if decoded != *data {
+				t.Errorf("%v: expected %v but got %v", data.Action, *data, decoded)
+			}
+		} else if decoded.Action != data.Action {
+			t.Errorf("%v: expected %v but got %v", data.Action, data.Action, decoded.Action)
+		}
+	}
+}
+
+func TestPostbackCodecTampered(t *testing.T) {
+	codec := newTestPostbackCodec(time.Now().Add(time.Hour))
+	str, err := codec.Encode(&PostbackData{Action: PostbackActionAddCart, ASIN: "B000000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope PostbackData
+	json.Unmarshal([]byte(str), &envelope)
+	other, _ := codec.Encode(&PostbackData{Action: PostbackActionAddCart, ASIN: "B000000002"})
+	var otherEnvelope PostbackData
+	json.Unmarshal([]byte(other), &otherEnvelope)
+	cases := []struct {
+		name   string
+		tamper func(data *PostbackData)
+	}{
+		{"action", func(data *PostbackData) { data.Action = PostbackActionClearCart }},
+		{"token", func(data *PostbackData) { data.Token = otherEnvelope.Token }},
+		{"signature", func(data *PostbackData) { data.Signature = otherEnvelope.Signature }},
+		{"no signature", func(data *PostbackData) { data.Signature = "" }},
+		{"unknown version", func(data *PostbackData) { data.Version = postbackVersion + 1 }},
+		{"token of other action", func(data *PostbackData) {
+			data.Action = PostbackActionIncreaseQuantity
+			data.Version = 0
+			data.Signature = ""
+		}},
+		{"unsigned removal", func(data *PostbackData) {
+			data.Action = PostbackActionRemoveCart
+			data.Version = 0
+			data.Signature = ""
+		}},
+	}
+	for _, c := range cases {
+		tampered := envelope
+		c.tamper(&tampered)
+		bytes, _ := json.Marshal(&tampered)
+		if _, err := codec.Decode(string(bytes)); err != errPostbackInvalid {
+			t.Errorf("%v: expected errPostbackInvalid but got %v", c.name, err)
+		}
+	}
+	if _, err := codec.Decode("{"); err != errPostbackInvalid {
+		t.Errorf("broken JSON: expected errPostbackInvalid but got %v", err)
+	}
+}
+
+func TestPostbackCodecUnsigned(t *testing.T) {
+	cases := []struct {
+		name          string
+		data          string
+		unsignedUntil time.Time
+		expected      error
+	}{
+		{"without window", `{"Action":"show-cart"}`, time.Time{}, errPostbackInvalid},
+		{"show in window", `{"Action":"show-cart"}`, time.Now().Add(time.Hour), nil},
+		{"next results in window", `{"Action":"next-results","Query":"golang","Page":2}`, time.Now().Add(time.Hour), nil},
+		{"add in window", `{"Action":"add-cart","ASIN":"B000000001"}`, time.Now().Add(time.Hour), nil},
+		{"increase in window", `{"Action":"increase-quantity","ASIN":"B000000001"}`, time.Now().Add(time.Hour), nil},
+		{"token in window", `{"Action":"add-cart","Token":"legacy"}`, time.Now().Add(time.Hour), nil},
+		{"add after window", `{"Action":"add-cart","ASIN":"B000000001"}`, time.Now().Add(-time.Hour), errPostbackInvalid},
+		{"clear in window", `{"Action":"clear-cart"}`, time.Now().Add(time.Hour), errPostbackInvalid},
+		{"remove in window", `{"Action":"remove-cart","ASIN":"B000000001"}`, time.Now().Add(time.Hour), errPostbackInvalid},
+		{"decrease in window", `{"Action":"decrease-quantity","ASIN":"B000000001"}`, time.Now().Add(time.Hour), errPostbackInvalid},
+		{"undo in window", `{"Action":"undo-cart"}`, time.Now().Add(time.Hour), errPostbackInvalid},
+		{"token of other action in window", `{"Action":"show-cart","Token":"legacy"}`, time.Now().Add(time.Hour), errPostbackInvalid},
+	}
+	for _, c := range cases {
+		codec := newTestPostbackCodec(c.unsignedUntil)
+		codec.Store.Set(postbackKeyPrefix+"legacy", `{"Action":"add-cart","ASIN":"B000000001"}`, time.Hour)
+		if _, err := codec.Decode(c.data); err != c.expected {
+			t.Errorf("%v: expected %v but got %v", c.name, c.expected, err)
+		}
+	}
+}
+
+func TestEnvDeadline(t *testing.T) {
+	app := &App{Store: NewMemoryStore()}
+	first, err := app.envDeadline("BUYCHAT_TEST_UNTIL", "BUYCHAT_TEST_WINDOW", time.Hour, "buychat:test-until")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(first); d <= 0 || d > time.Hour {
+		t.Errorf("expected deadline within an hour but got %v", first)
+	}
+	second, err := app.envDeadline("BUYCHAT_TEST_UNTIL", "BUYCHAT_TEST_WINDOW", 2*time.Hour, "buychat:test-until")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Equal(first.Truncate(time.Second)) {
+		t.Errorf("expected recorded deadline %v but got %v", first, second)
+	}
+}
+
+func TestPostbackCodecExpiredToken(t *testing.T) {
+	codec := newTestPostbackCodec(time.Time{})
+	str, err := codec.Encode(&PostbackData{Action: PostbackActionAddCart, ASIN: "B000000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope PostbackData
+	json.Unmarshal([]byte(str), &envelope)
+	codec.Store.Del(postbackKeyPrefix + envelope.Token)
+	if _, err := codec.Decode(str); err != errPostbackExpired {
+		t.Errorf("expected errPostbackExpired but got %v", err)
+	}
+}
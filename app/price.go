@@ -0,0 +1,86 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ngs/go-amazon-product-advertising-api/amazon"
+)
+
+// itemPrice returns lowest new price of the item, or list price when no offer
+// is available
+func itemPrice(item amazon.Item) (amount int, currency string, ok bool) {
+	for _, price := range []amazon.Price{item.OfferSummary.LowestNewPrice, item.ItemAttributes.ListPrice} {
+		if a, err := strconv.Atoi(price.Amount); err == nil && price.CurrencyCode != "" {
+			return a, price.CurrencyCode, true
+		}
+	}
+	return 0, "", false
+}
+
+// formatPrice formats amount in the smallest unit of the currency
+func formatPrice(amount int, currency string) string {
+	switch currency {
+	case "JPY":
+		return "￥ " + withThousandsSeparator(strconv.Itoa(amount))
+	}
+	return fmt.Sprintf("%v %v.%02d", currency, withThousandsSeparator(strconv.Itoa(amount/100)), amount%100)
+}
+
+func withThousandsSeparator(digits string) string {
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
+	}
+	return digits
+}
+
+// CartEstimate represents estimated total of items in cart
+type CartEstimate struct {
+	// Totals is total amount by currency
+	Totals map[string]int
+	// Unpriced is number of items without price
+	Unpriced int
+}
+
+func estimateCart(items []amazon.Item, quantities map[string]int) *CartEstimate {
+	estimate := &CartEstimate{Totals: map[string]int{}}
+	found := map[string]bool{}
+	for _, item := range items {
+		found[item.ASIN] = true
+		amount, currency, ok := itemPrice(item)
+		if !ok {
+			estimate.Unpriced++
+			continue
+		}
+		estimate.Totals[currency] += amount * quantities[item.ASIN]
+	}
+	for ASIN := range quantities {
+		if !found[ASIN] {
+			estimate.Unpriced++
+		}
+	}
+	return estimate
+}
+
+// String returns summary text of the estimate
+func (e *CartEstimate) String() string {
+	if len(e.Totals) == 0 {
+		return "合計金額は不明です"
+	}
+	currencies := []string{}
+	for currency := range e.Totals {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	totals := []string{}
+	for _, currency := range currencies {
+		totals = append(totals, formatPrice(e.Totals[currency], currency)+" ("+currency+")")
+	}
+	str := "合計金額の目安: " + strings.Join(totals, " + ")
+	if e.Unpriced > 0 {
+		str += "\n※価格不明の商品 " + strconv.Itoa(e.Unpriced) + "点を除く"
+	}
+	return str
+}
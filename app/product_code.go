@@ -0,0 +1,222 @@
+package app
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ngs/go-amazon-product-advertising-api/amazon"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ProductCodeKind represents kind of product code
+type ProductCodeKind string
+
+const (
+	// ProductCodeISBN ISBN-13, including ISBN-10 converted to ISBN-13
+	ProductCodeISBN ProductCodeKind = "ISBN"
+	// ProductCodeEAN13 JAN or EAN-13 other than ISBN
+	ProductCodeEAN13 ProductCodeKind = "JAN"
+	// ProductCodeEAN8 EAN-8
+	ProductCodeEAN8 ProductCodeKind = "EAN-8"
+	// ProductCodeUPCA UPC-A
+	ProductCodeUPCA ProductCodeKind = "UPC"
+)
+
+// ProductCode is a product code with valid check digit
+type ProductCode struct {
+	Kind ProductCodeKind
+	Code string
+}
+
+var productCodeRE = regexp.MustCompile(`[0-9][0-9\-]*[0-9Xx]`)
+
+func (code ProductCode) String() string {
+	return string(code.Kind) + " " + code.Code
+}
+
+// lookupParameters returns IDType, SearchIndex and ID for ItemLookup. The
+// Japan locale accepts neither ISBN nor UPC IDType, so ISBN-13 is looked up
+// as EAN in Books, and UPC-A as EAN-13 with leading zero. ISBNs missing in
+// Books are looked up again in All by lookupProductCodes.
+func (code ProductCode) lookupParameters() (amazon.IDType, amazon.SearchIndex, string) {
+	switch code.Kind {
+	case ProductCodeISBN:
+		return amazon.IDTypeEAN, amazon.SearchIndexBooks, code.Code
+	case ProductCodeUPCA:
+		return amazon.IDTypeEAN, amazon.SearchIndexAll, "0" + code.Code
+	}
+	return amazon.IDTypeEAN, amazon.SearchIndexAll, code.Code
+}
+
+// gtinCheckDigit returns check digit of EAN-8, UPC-A or EAN-13 digits without
+// the check digit
+func gtinCheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func isDigits(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] < '0' || str[i] > '9' {
+			return false
+		}
+	}
+	return str != ""
+}
+
+func isValidGTIN(code string) bool {
+	return isDigits(code) && gtinCheckDigit(code[:len(code)-1]) == code[len(code)-1]
+}
+
+func isValidISBN10(code string) bool {
+	if len(code) != 10 || !isDigits(code[:9]) {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(code[i]-'0')
+	}
+	switch c := code[9]; {
+	case c == 'X':
+		sum += 10
+	case c >= '0' && c <= '9':
+		sum += int(c - '0')
+	default:
+		return false
+	}
+	return sum%11 == 0
+}
+
+// isbn10To13 converts valid ISBN-10 to ISBN-13
+func isbn10To13(code string) string {
+	digits := "978" + code[:9]
+	return digits + string(gtinCheckDigit(digits))
+}
+
+// parseProductCode parses product code, ignoring hyphens
+func parseProductCode(str string) (ProductCode, bool) {
+	code := strings.ToUpper(strings.Replace(str, "-", "", -1))
+	switch len(code) {
+	case 8:
+		if isValidGTIN(code) {
+			return ProductCode{Kind: ProductCodeEAN8, Code: code}, true
+		}
+	case 10:
+		if isValidISBN10(code) {
+			return ProductCode{Kind: ProductCodeISBN, Code: isbn10To13(code)}, true
+		}
+	case 12:
+		if isValidGTIN(code) {
+			return ProductCode{Kind: ProductCodeUPCA, Code: code}, true
+		}
+	case 13:
+		if isValidGTIN(code) {
+			if strings.HasPrefix(code, "978") || strings.HasPrefix(code, "979") {
+				return ProductCode{Kind: ProductCodeISBN, Code: code}, true
+			}
+			return ProductCode{Kind: ProductCodeEAN13, Code: code}, true
+		}
+	}
+	return ProductCode{}, false
+}
+
+// findProductCodes returns valid product codes in the text, ignoring other
+// text such as labels and numbers which are not product codes
+func findProductCodes(text string) []ProductCode {
+	codes := []ProductCode{}
+	seen := map[string]bool{}
+	for _, str := range productCodeRE.FindAllString(norm.NFKC.String(text), -1) {
+		code, ok := parseProductCode(str)
+		if !ok || seen[code.Code] {
+			continue
+		}
+		seen[code.Code] = true
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// missingEANs returns EANs in ids which none of the items has
+func missingEANs(ids []string, items []amazon.Item) []string {
+	found := map[string]bool{}
+	for _, item := range items {
+		found[item.ItemAttributes.EAN] = true
+		for _, EAN := range item.ItemAttributes.EANList.Element {
+			found[EAN] = true
+		}
+	}
+	missing := []string{}
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+func describeProductCodes(codes []ProductCode) string {
+	strs := []string{}
+	for _, code := range codes {
+		strs = append(strs, code.String())
+	}
+	return strings.Join(strs, ", ")
+}
+
+// lookupProductCodes looks up items exactly matching the product codes
+func (app *App) lookupProductCodes(codes []ProductCode) ([]amazon.Item, error) {
+	type lookupKey struct {
+		idType amazon.IDType
+		index  amazon.SearchIndex
+	}
+	keys := []lookupKey{}
+	ids := map[lookupKey][]string{}
+	for _, code := range codes {
+		idType, index, id := code.lookupParameters()
+		key := lookupKey{idType, index}
+		if _, ok := ids[key]; !ok {
+			keys = append(keys, key)
+		}
+		ids[key] = append(ids[key], id)
+	}
+	items := []amazon.Item{}
+	seen := map[string]bool{}
+	lookup := func(ids []string, idType amazon.IDType, index amazon.SearchIndex) ([]amazon.Item, error) {
+		res, err := app.lookupItemsBy(ids, idType, index)
+		if kind := errorKindOf(err); kind == ErrorKindNoResults || kind == ErrorKindInvalidParameter {
+			app.Log.Printf("No exact match %v %v %v", err, index, ids)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range res {
+			if !seen[item.ASIN] {
+				seen[item.ASIN] = true
+				items = append(items, item)
+			}
+		}
+		return res, nil
+	}
+	for _, key := range keys {
+		res, err := lookup(ids[key], key.idType, key.index)
+		if err != nil {
+			return []amazon.Item{}, err
+		}
+		if key.index == amazon.SearchIndexAll {
+			continue
+		}
+		if missing := missingEANs(ids[key], res); len(missing) > 0 {
+			if _, err := lookup(missing, key.idType, amazon.SearchIndexAll); err != nil {
+				return []amazon.Item{}, err
+			}
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGTINCheckDigit(t *testing.T) {
+	cases := []struct {
+		digits   string
+		expected byte
+	}{
+		{"490108508917", '0'},
+		{"978487311752", '2'},
+		{"03600029145", '2'},
+		{"9638507", '4'},
+		{"000000000000", '0'},
+	}
+	for _, c := range cases {
+		if actual := gtinCheckDigit(c.digits); actual != c.expected {
+			t.Errorf("%v: expected %c but got %c", c.digits, c.expected, actual)
+		}
+	}
+}
+
+func TestIsValidISBN10(t *testing.T) {
+	cases := []struct {
+		code     string
+		expected bool
+	}{
+		{"4873117526", true},
+		{"4774142239", true},
+		{"080442957X", true},
+		{"4873117527", false},
+		{"477414223X", false},
+		{"X873117526", false},
+		{"487311752", false},
+		{"48731175260", false},
+	}
+	for _, c := range cases {
+		if actual := isValidISBN10(c.code); actual != c.expected {
+			t.Errorf("%v: expected %v but got %v", c.code, c.expected, actual)
+		}
+	}
+}
+
+func TestISBN10To13(t *testing.T) {
+	cases := []struct {
+		code     string
+		expected string
+	}{
+		{"4873117526", "9784873117522"},
+		{"4774142239", "9784774142234"},
+		{"080442957X", "9780804429573"},
+	}
+	for _, c := range cases {
+		if actual := isbn10To13(c.code); actual != c.expected {
+			t.Errorf("%v: expected %v but got %v", c.code, c.expected, actual)
+		}
+	}
+}
+
+func TestFindProductCodes(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected []ProductCode
+	}{
+		{"4901085089170", []ProductCode{{ProductCodeEAN13, "4901085089170"}}},
+		{"ISBN 978-4-87311-752-2", []ProductCode{{ProductCodeISBN, "9784873117522"}}},
+		{"ISBN-10: 4-87311-752-6", []ProductCode{{ProductCodeISBN, "9784873117522"}}},
+		{"080442957x", []ProductCode{{ProductCodeISBN, "9780804429573"}}},
+		{"UPC 036000291452", []ProductCode{{ProductCodeUPCA, "036000291452"}}},
+		{"EAN-8 96385074", []ProductCode{{ProductCodeEAN8, "96385074"}}},
+		{"４９０１０８５０８９１７０", []ProductCode{{ProductCodeEAN13, "4901085089170"}}},
+		{"jan: 4901085089170 と 9784873117522", []ProductCode{
+			{ProductCodeEAN13, "4901085089170"},
+			{ProductCodeISBN, "9784873117522"},
+		}},
+		{"4873117526, 9784873117522", []ProductCode{{ProductCodeISBN, "9784873117522"}}},
+		{"4901085089171", []ProductCode{}},
+		{"iPhone 12 ケース", []ProductCode{}},
+		{"ゴルーチン", []ProductCode{}},
+	}
+	for _, c := range cases {
+		if actual := findProductCodes(c.text); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%v: expected %v but got %v", c.text, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package app
+
+const profileKeyPrefix = "buychat:profile:"
+
+// DisplayName returns display name of the user cached for
+// CartPolicy.ProfileTTL, or empty string when the profile is not available
+func (app *App) DisplayName(userID string) string {
+	if userID == "" {
+		return ""
+	}
+	key := profileKeyPrefix + userID
+	if name, ok, err := app.Store.Get(key); err != nil {
+		app.Log.Printf("Failed to get cached profile %v %v", err, userID)
+	} else if ok {
+		return name
+	}
+	profile, err := app.Line.GetProfile(userID).Do()
+	if err != nil {
+		app.Log.Printf("Failed to get profile %v %v", err, userID)
+		return ""
+	}
+	if err := app.Store.Set(key, profile.DisplayName, app.CartPolicy.ProfileTTL); err != nil {
+		app.Log.Printf("Failed to cache profile %v %v", err, userID)
+	}
+	return profile.DisplayName
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BusyError is returned when no token becomes available within the wait limit
+type BusyError struct {
+	Wait time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("Rate limit exceeded, next request is available in %v", e.Wait)
+}
+
+// RateLimiter is a token bucket shared by all goroutines in the process
+type RateLimiter struct {
+	Rate    float64
+	Burst   float64
+	MaxWait time.Duration
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+}
+
+// NewRateLimiter returns new rate limiter which allows rate requests per
+// second with burst, waiting up to maxWait for each request
+func NewRateLimiter(rate float64, burst int, maxWait time.Duration) *RateLimiter {
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   float64(burst),
+		MaxWait: maxWait,
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+// Delay returns expected wait for next token without taking it
+func (l *RateLimiter) Delay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tokens := l.tokens + time.Since(l.last).Seconds()*l.Rate
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+}
+
+// Wait blocks until a token is available. It returns BusyError without
+// waiting when the token would not become available within MaxWait.
+func (l *RateLimiter) Wait() error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.Rate
+	if l.tokens > l.Burst {
+		l.tokens = l.Burst
+	}
+	l.last = now
+	l.tokens--
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.Rate * float64(time.Second))
+	}
+	if wait > l.MaxWait {
+		l.tokens++
+		l.mu.Unlock()
+		return &BusyError{Wait: wait}
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+	return nil
+}
+
+func isBusyError(err error) bool {
+	_, ok := err.(*BusyError)
+	return ok
+}
@@ -7,41 +7,80 @@ import (
 	"github.com/garyburd/redigo/redis"
 )
 
-// ReconnectRedisIfNeeeded ReconnectRedisIfNeeeded
-func (app *App) ReconnectRedisIfNeeeded() {
-	res, _ := app.RedisConn.Do("PING")
-	if pong, ok := res.([]byte); !ok || string(pong) != "PONG" {
-		err := app.SetupRedis()
-		if err != nil {
-			panic(err)
-		}
+// RedisConfig represents Redis connection pool configuration
+type RedisConfig struct {
+	URL            string
+	MaxIdle        int
+	MaxActive      int
+	IdleTimeout    time.Duration
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+}
+
+// RedisConfigFromEnvironment returns Redis configuration from environment variables
+func RedisConfigFromEnvironment() (*RedisConfig, error) {
+	var err error
+	config := &RedisConfig{URL: os.Getenv("REDIS_URL")}
+	if config.URL == "" {
+		config.URL = "redis://localhost:6379"
+	}
+	if config.MaxIdle, err = envInt("REDIS_MAX_IDLE", 3); err != nil {
+		return nil, err
+	}
+	if config.MaxActive, err = envInt("REDIS_MAX_ACTIVE", 10); err != nil {
+		return nil, err
+	}
+	if config.IdleTimeout, err = envDuration("REDIS_IDLE_TIMEOUT", 240*time.Second); err != nil {
+		return nil, err
+	}
+	if config.ConnectTimeout, err = envDuration("REDIS_CONNECT_TIMEOUT", time.Second); err != nil {
+		return nil, err
+	}
+	if config.ReadTimeout, err = envDuration("REDIS_READ_TIMEOUT", time.Second); err != nil {
+		return nil, err
+	}
+	if config.WriteTimeout, err = envDuration("REDIS_WRITE_TIMEOUT", time.Second); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// NewRedisPool returns new Redis connection pool
+func NewRedisPool(config *RedisConfig) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     config.MaxIdle,
+		MaxActive:   config.MaxActive,
+		IdleTimeout: config.IdleTimeout,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(config.URL,
+				redis.DialConnectTimeout(config.ConnectTimeout),
+				redis.DialReadTimeout(config.ReadTimeout),
+				redis.DialWriteTimeout(config.WriteTimeout))
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
 	}
 }
 
 // SetupRedis SetupRedis
 func (app *App) SetupRedis() error {
-	connectTimeout := 1 * time.Second
-	readTimeout := 1 * time.Second
-	writeTimeout := 1 * time.Second
-
-	if url := os.Getenv("REDIS_URL"); url != "" {
-		conn, err := redis.DialURL(url,
-			redis.DialConnectTimeout(connectTimeout),
-			redis.DialReadTimeout(readTimeout),
-			redis.DialWriteTimeout(writeTimeout))
-		if err != nil {
-			return err
-		}
-		app.RedisConn = conn
-		return nil
-	}
-	conn, err := redis.Dial("tcp", ":6379",
-		redis.DialConnectTimeout(connectTimeout),
-		redis.DialReadTimeout(readTimeout),
-		redis.DialWriteTimeout(writeTimeout))
+	config, err := RedisConfigFromEnvironment()
 	if err != nil {
 		return err
 	}
-	app.RedisConn = conn
+	pool := NewRedisPool(config)
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return err
+	}
+	app.RedisPool = pool
 	return nil
 }
@@ -0,0 +1,357 @@
+package app
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const cartIndexKey = "buychat:carts"
+const cartExpiredIndexKey = "buychat:carts:expired"
+const cartAddedByKeyPrefix = "buychat:cart-added-by:"
+
+// migrationKeyPrefix prefixes keys recording completed migrations
+const migrationKeyPrefix = "buychat:migrations:"
+
+// RedisCartStore stores carts as Redis hashes of ASIN and quantity, along
+// with hashes of ASIN and ID of the user who added the item
+type RedisCartStore struct {
+	Pool *redis.Pool
+}
+
+var addCartItemScript = redis.NewScript(2, `
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+  return "duplicate"
+end
+if redis.call("HLEN", KEYS[1]) >= tonumber(ARGV[2]) then
+  return "full"
+end
+redis.call("HSET", KEYS[1], ARGV[1], 1)
+if ARGV[3] ~= "" then
+  redis.call("HSET", KEYS[2], ARGV[1], ARGV[3])
+  local ttl = redis.call("PTTL", KEYS[1])
+  if ttl > 0 then
+    redis.call("PEXPIRE", KEYS[2], ttl)
+  end
+end
+return "added"
+`)
+
+var changeCartItemQuantityScript = redis.NewScript(2, `
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+  return 0
+end
+local quantity = redis.call("HINCRBY", KEYS[1], ARGV[1], ARGV[2])
+if quantity <= 0 then
+  redis.call("HDEL", KEYS[1], ARGV[1])
+  redis.call("HDEL", KEYS[2], ARGV[1])
+  return 0
+end
+return quantity
+`)
+
+var migrateListCartScript = redis.NewScript(1, `
+if redis.call("TYPE", KEYS[1]).ok ~= "list" then
+  return 0
+end
+local items = redis.call("LRANGE", KEYS[1], 0, -1)
+redis.call("DEL", KEYS[1])
+for _, item in ipairs(items) do
+  redis.call("HINCRBY", KEYS[1], item, 1)
+end
+return 1
+`)
+
+var indexCartScript = redis.NewScript(3, `
+if redis.call("TYPE", KEYS[1]).ok ~= "hash" or redis.call("ZSCORE", KEYS[2], KEYS[1]) then
+  return 0
+end
+redis.call("PEXPIREAT", KEYS[1], ARGV[1])
+redis.call("PEXPIREAT", KEYS[3], ARGV[1])
+redis.call("ZADD", KEYS[2], ARGV[1], KEYS[1])
+return 1
+`)
+
+var touchCartScript = redis.NewScript(4, `
+local expired = 0
+local score = redis.call("ZSCORE", KEYS[2], KEYS[1])
+if score and tonumber(score) <= tonumber(ARGV[2]) then
+  redis.call("ZREM", KEYS[2], KEYS[1])
+  redis.call("ZADD", KEYS[3], score, KEYS[1])
+  expired = 1
+end
+if redis.call("EXISTS", KEYS[1]) == 0 then
+  redis.call("ZREM", KEYS[2], KEYS[1])
+  redis.call("DEL", KEYS[4])
+  return expired
+end
+redis.call("PEXPIREAT", KEYS[1], ARGV[1])
+redis.call("PEXPIREAT", KEYS[4], ARGV[1])
+redis.call("ZADD", KEYS[2], ARGV[1], KEYS[1])
+return expired
+`)
+
+var expireCartScript = redis.NewScript(2, `
+local score = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not score or tonumber(score) ~= tonumber(ARGV[2]) then
+  return 0
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZADD", KEYS[2], score, ARGV[1])
+return 1
+`)
+
+func cartAddedByKey(cartKey string) string {
+	return cartAddedByKeyPrefix + cartKey
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// isWrongTypeError returns true when the key holds a value of another type,
+// including errors of redis.call in scripts
+func isWrongTypeError(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.Contains(string(e), "WRONGTYPE")
+}
+
+// migrateOnWrongType runs fn, and runs it again after converting the cart into
+// a hash when it is a list cart, such as one written by an instance older than
+// MigrateListCarts during a rolling deploy
+func migrateOnWrongType(conn redis.Conn, cartKey string, fn func() error) error {
+	err := fn()
+	if !isWrongTypeError(err) {
+		return err
+	}
+	if _, err := migrateListCartScript.Do(conn, cartKey); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// Size returns cart size
+func (s *RedisCartStore) Size(cartKey string) (int, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	var size int
+	err := migrateOnWrongType(conn, cartKey, func() (err error) {
+		size, err = redis.Int(conn.Do("HLEN", cartKey))
+		return
+	})
+	return size, err
+}
+
+// Clear clears items
+func (s *RedisCartStore) Clear(cartKey string) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", cartKey, cartAddedByKey(cartKey))
+	return err
+}
+
+// Add adds items to cart
+func (s *RedisCartStore) Add(cartKey string, ASIN string, addedBy string, capacity int) (CartAddResult, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	var res string
+	err := migrateOnWrongType(conn, cartKey, func() (err error) {
+		res, err = redis.String(addCartItemScript.Do(conn, cartKey, cartAddedByKey(cartKey), ASIN, capacity, addedBy))
+		return
+	})
+	return CartAddResult(res), err
+}
+
+// Remove removes items from cart
+func (s *RedisCartStore) Remove(cartKey string, ASIN string) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	return migrateOnWrongType(conn, cartKey, func() error {
+		conn.Send("MULTI")
+		conn.Send("HDEL", cartKey, ASIN)
+		conn.Send("HDEL", cartAddedByKey(cartKey), ASIN)
+		values, err := redis.Values(conn.Do("EXEC"))
+		for _, value := range values {
+			if e, ok := value.(redis.Error); ok && err == nil {
+				err = e
+			}
+		}
+		return err
+	})
+}
+
+// ChangeQuantity changes quantity of the item
+func (s *RedisCartStore) ChangeQuantity(cartKey string, ASIN string, delta int) (int, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	var quantity int
+	err := migrateOnWrongType(conn, cartKey, func() (err error) {
+		quantity, err = redis.Int(changeCartItemQuantityScript.Do(conn, cartKey, cartAddedByKey(cartKey), ASIN, delta))
+		return
+	})
+	return quantity, err
+}
+
+// Items returns items in cart
+func (s *RedisCartStore) Items(cartKey string) ([]CartItem, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	var values []interface{}
+	err := migrateOnWrongType(conn, cartKey, func() (err error) {
+		values, err = redis.Values(conn.Do("HGETALL", cartKey))
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	addedBy, err := redis.StringMap(conn.Do("HGETALL", cartAddedByKey(cartKey)))
+	if err != nil {
+		return nil, err
+	}
+	items := []CartItem{}
+	for len(values) > 0 {
+		var item CartItem
+		if values, err = redis.Scan(values, &item.ASIN, &item.Quantity); err != nil {
+			return nil, err
+		}
+		item.AddedBy = addedBy[item.ASIN]
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// IndexCarts sets expiry of carts which are not in the index, such as carts
+// created before carts expired, and returns number of indexed carts. It scans
+// carts only once per database.
+func (s *RedisCartStore) IndexCarts(expiresAt time.Time) (int, error) {
+	return s.migrateOnce("index-carts", func(conn redis.Conn) (int, error) {
+		indexed := 0
+		err := scanCarts(conn, func(key string) error {
+			n, err := redis.Int(indexCartScript.Do(conn, key, cartIndexKey, cartAddedByKey(key), unixMillis(expiresAt)))
+			indexed += n
+			return err
+		})
+		return indexed, err
+	})
+}
+
+// Touch sets expiry of the cart
+func (s *RedisCartStore) Touch(cartKey string, expiresAt time.Time) (bool, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	return redis.Bool(touchCartScript.Do(conn, cartKey, cartIndexKey, cartExpiredIndexKey, cartAddedByKey(cartKey),
+		unixMillis(expiresAt), unixMillis(time.Now())))
+}
+
+// Expiring returns carts expiring before t
+func (s *RedisCartStore) Expiring(t time.Time) ([]CartExpiry, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	values, err := redis.Values(conn.Do("ZRANGEBYSCORE", cartIndexKey, "-inf", unixMillis(t), "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	expiries := []CartExpiry{}
+	for len(values) > 0 {
+		var cartKey string
+		var ms int64
+		if values, err = redis.Scan(values, &cartKey, &ms); err != nil {
+			return nil, err
+		}
+		expiries = append(expiries, CartExpiry{CartKey: cartKey, ExpiresAt: fromUnixMillis(ms)})
+	}
+	return expiries, nil
+}
+
+// Expire moves the cart to the expired index
+func (s *RedisCartStore) Expire(expiry CartExpiry) (bool, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	return redis.Bool(expireCartScript.Do(conn, cartIndexKey, cartExpiredIndexKey,
+		expiry.CartKey, unixMillis(expiry.ExpiresAt)))
+}
+
+// Count returns numbers of active and expired carts
+func (s *RedisCartStore) Count(t time.Time) (CartCount, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	ms := unixMillis(t)
+	conn.Send("MULTI")
+	conn.Send("ZCOUNT", cartIndexKey, "("+strconv.FormatInt(ms, 10), "+inf")
+	conn.Send("ZCOUNT", cartIndexKey, "-inf", ms)
+	conn.Send("ZCARD", cartExpiredIndexKey)
+	counts, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return CartCount{}, err
+	}
+	return CartCount{Active: counts[0], Expired: counts[1] + counts[2]}, nil
+}
+
+// PruneExpired removes carts expired before t from the expired index
+func (s *RedisCartStore) PruneExpired(t time.Time) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("ZREMRANGEBYSCORE", cartExpiredIndexKey, "-inf", "("+strconv.FormatInt(unixMillis(t), 10))
+	return err
+}
+
+// migrateOnce runs migration fn unless the marker key of the name records
+// it completed, and records completion after fn succeeds
+func (s *RedisCartStore) migrateOnce(name string, fn func(conn redis.Conn) (int, error)) (int, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	key := migrationKeyPrefix + name
+	if done, err := redis.Bool(conn.Do("EXISTS", key)); err != nil || done {
+		return 0, err
+	}
+	migrated, err := fn(conn)
+	if err != nil {
+		return migrated, err
+	}
+	_, err = conn.Do("SET", key, time.Now().Format(time.RFC3339))
+	return migrated, err
+}
+
+// scanCarts calls fn with keys matching the cart key prefix
+func scanCarts(conn redis.Conn, fn func(key string) error) error {
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", cartKeyPrefix+"*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// MigrateListCarts converts carts stored as lists of ASINs into hashes and
+// returns number of converted carts. It scans carts only once per database;
+// list carts written after that are converted on access.
+func (s *RedisCartStore) MigrateListCarts() (int, error) {
+	return s.migrateOnce("list-carts", func(conn redis.Conn) (int, error) {
+		migrated := 0
+		err := scanCarts(conn, func(key string) error {
+			n, err := redis.Int(migrateListCartScript.Do(conn, key))
+			migrated += n
+			return err
+		})
+		return migrated, err
+	})
+}
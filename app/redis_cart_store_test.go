@@ -0,0 +1,26 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestIsWrongTypeError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected bool
+	}{
+		{redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"), true},
+		{redis.Error("ERR Error running script (call to f_0123): @user_script:2: WRONGTYPE Operation against a key holding the wrong kind of value"), true},
+		{redis.Error("ERR unknown command"), false},
+		{errors.New("WRONGTYPE"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if actual := isWrongTypeError(c.err); actual != c.expected {
+			t.Errorf("%v: expected %v but got %v", c.err, c.expected, actual)
+		}
+	}
+}
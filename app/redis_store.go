@@ -0,0 +1,115 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// redisUpdateAttempts is the maximum number of optimistic transactions Update
+// runs before giving up on concurrent writers
+const redisUpdateAttempts = 10
+
+// RedisStore stores state in Redis
+type RedisStore struct {
+	Pool *redis.Pool
+}
+
+// PushList prepends value to list
+func (s *RedisStore) PushList(key string, value string, max int) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("LPUSH", key, value)
+	conn.Send("LTRIM", key, 0, max-1)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// List returns values in list
+func (s *RedisStore) List(key string, n int) ([]string, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("LRANGE", key, 0, n-1))
+}
+
+// SetNX sets value if key does not exist
+func (s *RedisStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	res, err := redis.String(conn.Do("SET", key, value, "PX", int64(ttl/time.Millisecond), "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return res == "OK", err
+}
+
+// Set sets value
+func (s *RedisStore) Set(key string, value string, ttl time.Duration) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	var err error
+	if ttl > 0 {
+		_, err = conn.Do("SET", key, value, "PX", int64(ttl/time.Millisecond))
+	} else {
+		_, err = conn.Do("SET", key, value)
+	}
+	return err
+}
+
+// Get returns value
+func (s *RedisStore) Get(key string) (string, bool, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	value, err := redis.String(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return "", false, nil
+	}
+	return value, err == nil, err
+}
+
+// Del deletes key
+func (s *RedisStore) Del(key string) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+// Update replaces value with the one fn returns, retrying when the key is
+// written while fn runs
+func (s *RedisStore) Update(key string, ttl time.Duration, fn func(value string, ok bool) (string, error)) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	for i := 0; i < redisUpdateAttempts; i++ {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return err
+		}
+		current, err := redis.String(conn.Do("GET", key))
+		ok := err == nil
+		if err != nil && err != redis.ErrNil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		value, err := fn(current, ok)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		conn.Send("MULTI")
+		if ttl > 0 {
+			conn.Send("SET", key, value, "PX", int64(ttl/time.Millisecond))
+		} else {
+			conn.Send("SET", key, value)
+		}
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("Too many concurrent updates of %v", key)
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy retries operations with exponential backoff and jitter until
+// retries or deadline are exhausted
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Deadline   time.Duration
+	Retryable  func(err error) bool
+	Log        *log.Logger
+}
+
+// RetryPolicyFromEnvironment returns retry policy configured with environment
+// variables prefixed with prefix
+func RetryPolicyFromEnvironment(prefix string, logger *log.Logger) (*RetryPolicy, error) {
+	var err error
+	policy := &RetryPolicy{Log: logger}
+	if policy.MaxRetries, err = envInt(prefix+"_RETRY_MAX", 5); err != nil {
+		return nil, err
+	}
+	if policy.BaseDelay, err = envDuration(prefix+"_RETRY_BASE_DELAY", 500*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if policy.MaxDelay, err = envDuration(prefix+"_RETRY_MAX_DELAY", 4*time.Second); err != nil {
+		return nil, err
+	}
+	if policy.Deadline, err = envDuration(prefix+"_RETRY_DEADLINE", 10*time.Second); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Delay returns wait duration before the retry
+func (p *RetryPolicy) Delay(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Do calls fn until it succeeds, returns an error which is not retryable, or
+// retries or deadline are exhausted
+func (p *RetryPolicy) Do(name string, fn func() error) error {
+	start := time.Now()
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil {
+			if retry > 0 {
+				p.Log.Printf("%v succeeded after %d retries in %v", name, retry, time.Since(start))
+			}
+			return nil
+		}
+		if p.Retryable == nil || !p.Retryable(err) {
+			return err
+		}
+		if retry >= p.MaxRetries {
+			p.Log.Printf("%v gave up after %d retries in %v: %v", name, retry, time.Since(start), err)
+			return err
+		}
+		delay := p.Delay(retry + 1)
+		if p.Deadline > 0 && time.Since(start)+delay > p.Deadline {
+			p.Log.Printf("%v gave up after %d retries, deadline %v exceeded: %v", name, retry, p.Deadline, err)
+			return err
+		}
+		p.Log.Printf("Retrying %v %d/%d in %v: %v", name, retry+1, p.MaxRetries, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+func (p *RetryPolicy) String() string {
+	return fmt.Sprintf("max %d retries, delay %v-%v, deadline %v", p.MaxRetries, p.BaseDelay, p.MaxDelay, p.Deadline)
+}
@@ -0,0 +1,24 @@
+package app
+
+import "time"
+
+// Store stores application state other than carts
+type Store interface {
+	// PushList prepends value to the list at key, keeping at most max values
+	PushList(key string, value string, max int) error
+	// List returns up to n values in the list at key, newest first
+	List(key string, n int) ([]string, error)
+	// SetNX sets value at key expiring after ttl only if key does not exist,
+	// and returns whether it was set
+	SetNX(key string, value string, ttl time.Duration) (bool, error)
+	// Set sets value at key expiring after ttl, or never when ttl is zero
+	Set(key string, value string, ttl time.Duration) error
+	// Get returns value at key and whether it exists
+	Get(key string) (string, bool, error)
+	// Del deletes key
+	Del(key string) error
+	// Update atomically replaces value at key with the one fn returns for the
+	// current value, expiring after ttl, or never when ttl is zero. Nothing is
+	// written when fn returns error, which Update returns as is.
+	Update(key string, ttl time.Duration, fn func(value string, ok bool) (string, error)) error
+}
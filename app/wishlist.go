@@ -0,0 +1,199 @@
+package app
+
+import (
+	"strconv"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/ngs/go-amazon-product-advertising-api/amazon"
+)
+
+const wishlistKeyPrefix = "buychat:wishlist:"
+
+// wishlistKey returns key of the wishlist of the source of the cart key, which
+// is stored in the cart store without expiry
+func wishlistKey(cartKey string) string {
+	return wishlistKeyPrefix + cartSourceKey(cartKey)
+}
+
+func showWishlistAction(encoder *postbackEncoder) linebot.TemplateAction {
+	return encoder.Action("ほしいものリスト", &PostbackData{Action: PostbackActionShowWishlist})
+}
+
+func addWishlistAction(encoder *postbackEncoder, data *PostbackData) linebot.TemplateAction {
+	return encoder.Action("あとで買う", &PostbackData{
+		Action:   PostbackActionAddWishlist,
+		ASIN:     data.ASIN,
+		ImageURL: data.ImageURL,
+		Label:    data.Label,
+		Title:    data.Title,
+	})
+}
+
+// HandleAddWishlist handles add wishlist
+func (app *App) HandleAddWishlist(delivery *Delivery, data PostbackData, cartKey string) error {
+	delivery.MarkChanged()
+	result, err := app.Carts.Add(wishlistKey(cartKey), data.ASIN, delivery.UserID, app.CartPolicy.WishlistCapacity)
+	if err != nil {
+		return storageError(err)
+	}
+	encoder := &postbackEncoder{app: app}
+	var msg linebot.Message
+	switch result {
+	case CartAddResultFull:
+		msg = linebot.NewTemplateMessage("ほしいものリストが一杯です",
+			linebot.NewButtonsTemplate("", "", "ほしいものリストが一杯です (最大"+strconv.Itoa(app.CartPolicy.WishlistCapacity)+"点)",
+				showWishlistAction(encoder)))
+	case CartAddResultDuplicate:
+		msg = linebot.NewTemplateMessage("すでにほしいものリストに入っています: "+data.Title,
+			linebot.NewButtonsTemplate(data.ImageURL, data.Title, "すでにほしいものリストに入っています",
+				showWishlistAction(encoder)))
+	default:
+		msg = linebot.NewTemplateMessage("ほしいものリストに追加しました: "+data.Title,
+			linebot.NewButtonsTemplate(data.ImageURL, data.Title, "ほしいものリストに追加しました",
+				showWishlistAction(encoder)))
+	}
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return app.Reply(delivery, msg)
+}
+
+// HandleShowWishlist handles show wishlist, showing up to 3 carousels from page
+// and looking up only items on the page
+func (app *App) HandleShowWishlist(delivery *Delivery, cartKey string, page int) error {
+	wishlistItems, err := app.Carts.Items(wishlistKey(cartKey))
+	if err != nil {
+		return storageError(err)
+	}
+	if len(wishlistItems) == 0 {
+		return app.ReplyText(delivery, "ほしいものリストは空です。検索結果の「あとで買う」で追加できます")
+	}
+	start, end := pageRange(len(wishlistItems), page)
+	more := end < len(wishlistItems)
+	ids := []string{}
+	for _, item := range wishlistItems[start:end] {
+		ids = append(ids, item.ASIN)
+	}
+	items := []amazon.Item{}
+	if len(ids) > 0 {
+		if items, err = app.lookupItems(ids); err != nil {
+			return err
+		}
+	}
+	addedBy := app.addedByLabels(wishlistItems, isSharedCart(cartKey))
+	encoder := &postbackEncoder{app: app}
+	messages, _ := pagedItemCarousels(items, 0, "ほしいものリスト",
+		func(item amazon.Item, label string) string {
+			return addedBy[item.ASIN] + label
+		},
+		func(item amazon.Item, imgURL string, label string, title string) []linebot.TemplateAction {
+			postbackData := func(action PostbackAction) string {
+				return encoder.Encode(&PostbackData{
+					Action:   action,
+					ASIN:     item.ASIN,
+					ImageURL: imgURL,
+					Label:    label,
+					Title:    title,
+				})
+			}
+			return []linebot.TemplateAction{
+				linebot.NewPostbackTemplateAction("カートに移す", postbackData(PostbackActionMoveToCart), ""),
+				linebot.NewPostbackTemplateAction("リストから削除", postbackData(PostbackActionRemoveWishlist), ""),
+				linebot.NewURITemplateAction("Amazon で見る", item.DetailPageURL),
+			}
+		})
+	summary := "ほしいものリストに " + strconv.Itoa(len(wishlistItems)) + "点の商品があります"
+	if page > 0 || more {
+		summary += "\n(" + strconv.Itoa(page+1) + "ページ目)"
+	}
+	messages = append([]linebot.Message{linebot.NewTextMessage(summary)}, messages...)
+	if more {
+		messages = append(messages, linebot.NewTemplateMessage("次のページ",
+			linebot.NewButtonsTemplate("", "", "ほしいものリストの続きがあります",
+				encoder.Action("次のページ", &PostbackData{Action: PostbackActionShowWishlist, Page: page + 1}),
+			)))
+	}
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return app.Reply(delivery, messages...)
+}
+
+// HandleRemoveWishlist handles remove wishlist
+func (app *App) HandleRemoveWishlist(delivery *Delivery, data PostbackData, cartKey string) error {
+	delivery.MarkChanged()
+	if err := app.Carts.Remove(wishlistKey(cartKey), data.ASIN); err != nil {
+		return storageError(err)
+	}
+	return app.ReplyText(delivery, "ほしいものリストから削除しました: "+data.Title)
+}
+
+// HandleMoveToCart adds the wishlist item to the active cart, and removes it
+// from the wishlist once it is in the cart. HandleAddCart has replied by then,
+// so failure to remove is only logged.
+func (app *App) HandleMoveToCart(delivery *Delivery, data PostbackData, cartKey string) error {
+	if err := app.HandleAddCart(delivery, data, cartKey); err != nil {
+		return err
+	}
+	item, err := app.getCartItem(cartKey, data.ASIN)
+	if err == nil && item != nil {
+		err = app.Carts.Remove(wishlistKey(cartKey), data.ASIN)
+	}
+	if err != nil {
+		app.Log.Printf("Failed to remove moved item from wishlist %v %v %v", err, cartKey, data.ASIN)
+	}
+	return nil
+}
+
+// HandleMoveToWishlist adds the cart item to the wishlist, and removes it
+// from the cart unless the wishlist is full
+func (app *App) HandleMoveToWishlist(delivery *Delivery, data PostbackData, cartKey string) error {
+	if addedBy, err := app.removalDeniedBy(cartKey, data.ASIN, delivery.UserID); err != nil {
+		return err
+	} else if addedBy != "" {
+		return app.replyRemovalDenied(delivery, addedBy)
+	}
+	item, err := app.getCartItem(cartKey, data.ASIN)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return app.ReplyText(delivery, app.cartLabel(cartKey)+"に入っていません: "+data.Title)
+	}
+	delivery.MarkChanged()
+	result, err := app.Carts.Add(wishlistKey(cartKey), data.ASIN, item.AddedBy, app.CartPolicy.WishlistCapacity)
+	if err != nil {
+		return storageError(err)
+	}
+	encoder := &postbackEncoder{app: app}
+	if result == CartAddResultFull {
+		msg := linebot.NewTemplateMessage("ほしいものリストが一杯です",
+			linebot.NewButtonsTemplate("", "", "ほしいものリストが一杯です (最大"+strconv.Itoa(app.CartPolicy.WishlistCapacity)+"点)",
+				showWishlistAction(encoder)))
+		if encoder.err != nil {
+			return encoder.err
+		}
+		return app.Reply(delivery, msg)
+	}
+	if err := app.RemoveCartItem(cartKey, data.ASIN); err != nil {
+		return err
+	}
+	changeID := app.recordCartChange(cartKey, &CartChange{
+		Action: CartChangeRemove,
+		ASIN:   data.ASIN,
+		Title:  data.Title,
+		Items:  []CartItem{*item},
+		UserID: delivery.UserID,
+	})
+	text := "ほしいものリストに移しました: " + data.Title
+	actions := []linebot.TemplateAction{showWishlistAction(encoder)}
+	if changeID != "" {
+		actions = append(actions, undoCartAction(encoder, cartKey, changeID))
+	}
+	msg := linebot.NewTemplateMessage(text,
+		linebot.NewButtonsTemplate("", "", truncateRunes(text, 160), actions...))
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return app.Reply(delivery, msg)
+}
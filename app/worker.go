@@ -0,0 +1,133 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/stvp/rollbar"
+)
+
+const deadLetterKey = "buychat:dead-letters"
+const deadLetterMax = 1000
+
+// EventQueue is a bounded queue of webhook events processed by workers
+type EventQueue struct {
+	Workers     int
+	MaxAttempts int
+	RetryDelay  time.Duration
+	DedupeTTL   time.Duration
+	events      chan *linebot.Event
+}
+
+// DeadLetter represents an event which kept failing
+type DeadLetter struct {
+	Event    *linebot.Event
+	Error    string
+	Attempts int
+	FailedAt time.Time
+}
+
+// SetupEventQueue sets up event queue
+func (app *App) SetupEventQueue() error {
+	workers, err := envInt("WORKER_COUNT", 4)
+	if err != nil {
+		return err
+	}
+	size, err := envInt("WORKER_QUEUE_SIZE", 100)
+	if err != nil {
+		return err
+	}
+	maxAttempts, err := envInt("EVENT_MAX_ATTEMPTS", 3)
+	if err != nil {
+		return err
+	}
+	retryDelay, err := envDuration("EVENT_RETRY_DELAY", time.Second)
+	if err != nil {
+		return err
+	}
+	dedupeTTL, err := envDuration("EVENT_DEDUPE_TTL", time.Hour)
+	if err != nil {
+		return err
+	}
+	app.Queue = &EventQueue{
+		Workers:     workers,
+		MaxAttempts: maxAttempts,
+		RetryDelay:  retryDelay,
+		DedupeTTL:   dedupeTTL,
+		events:      make(chan *linebot.Event, size),
+	}
+	return nil
+}
+
+// StartWorkers starts workers processing queued events
+func (app *App) StartWorkers() {
+	for i := 0; i < app.Queue.Workers; i++ {
+		go func() {
+			for event := range app.Queue.events {
+				app.processEvent(event)
+			}
+		}()
+	}
+}
+
+// Enqueue queues event and returns false if the queue is full
+func (app *App) Enqueue(event *linebot.Event) bool {
+	select {
+	case app.Queue.events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+func (app *App) processEvent(event *linebot.Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			app.Log.Printf("Recovered from panic %v %v", r, event)
+			rollbar.Error(rollbar.CRIT, fmt.Errorf("%v", r))
+		}
+	}()
+	if !app.claimEvent(event) {
+		app.Log.Printf("Skipping redelivered event %v", event)
+		return
+	}
+	delivery := NewDelivery(event)
+	var err error
+	attempts := 0
+	for attempts < app.Queue.MaxAttempts {
+		attempts++
+		if err = app.HandleEvent(delivery, event); err == nil || !shouldReportError(err) || !delivery.Retryable() {
+			break
+		}
+		app.Log.Printf("Got error on attempt %d/%d %v %v", attempts, app.Queue.MaxAttempts, err, event)
+		if attempts < app.Queue.MaxAttempts {
+			time.Sleep(app.Queue.RetryDelay)
+		}
+	}
+	if err == nil {
+		return
+	}
+	app.Log.Printf("Got error %v %v", err, event)
+	if shouldReportError(err) {
+		rollbar.Error(rollbar.ERR, err)
+		app.pushDeadLetter(event, err, attempts)
+	}
+	if err := app.ReplyText(delivery, ErrorMessage(err)); err != nil {
+		rollbar.Error(rollbar.ERR, err)
+		app.Log.Printf("Got error again %v %v", err, event)
+	}
+}
+
+func (app *App) pushDeadLetter(event *linebot.Event, err error, attempts int) {
+	data, _ := json.Marshal(&DeadLetter{
+		Event:    event,
+		Error:    err.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	})
+	if err := app.Store.PushList(deadLetterKey, string(data), deadLetterMax); err != nil {
+		app.Log.Printf("Failed to push dead letter %v %v", err, string(data))
+	}
+}